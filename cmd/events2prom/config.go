@@ -14,9 +14,11 @@
 package main
 
 import (
+	"fmt"
 	"os"
 	"time"
 
+	"github.com/prometheus/common/model"
 	"github.com/rakyll/events2prom/engine"
 	"gopkg.in/yaml.v2"
 )
@@ -47,7 +49,28 @@ type serverConfig struct {
 	// thirty seconds.
 	Window time.Duration `yaml:"window,omitempty"`
 
+	// TTL is the default amount of duration a label set is exported
+	// after its last event, for collections that don't set a TTL.
+	// Label sets never expire if zero.
+	TTL time.Duration `yaml:"ttl,omitempty"`
+
+	// MaxSeries is the max number of label sets to export for all
+	// collections. Once reached, events with new label sets are
+	// aggregated in the overflow series of their collection.
+	// No limit if zero.
+	MaxSeries int `yaml:"max_series,omitempty"`
+
+	// Workers is the max number of collections to aggregate
+	// concurrently. Defaults to the number of CPUs.
+	Workers int `yaml:"workers,omitempty"`
+
+	// ExternalLabels are labels with fixed values added to all
+	// exported series, e.g. the node or the cluster name.
+	// Values can refer to environment variables, e.g. ${NODE_NAME}.
+	ExternalLabels map[string]string `yaml:"external_labels,omitempty"`
+
 	// Collections are the collections to enable at start.
+	// Values of const labels can refer to environment variables.
 	Collections []engine.Collection `yaml:"collections,omitempty"`
 }
 
@@ -65,6 +88,17 @@ func readConfig(filename string) (serverConfig, error) {
 			return serverConfig{}, err
 		}
 	}
+	for name, value := range c.ExternalLabels {
+		if !model.LabelName(name).IsValid() {
+			return serverConfig{}, fmt.Errorf("invalid external label %q", name)
+		}
+		c.ExternalLabels[name] = os.ExpandEnv(value)
+	}
+	for _, col := range c.Collections {
+		for name, value := range col.ConstLabels {
+			col.ConstLabels[name] = os.ExpandEnv(value)
+		}
+	}
 	if c.Port == 0 {
 		c.Port = defaultPort
 	}
@@ -14,12 +14,13 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
 
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rakyll/events2prom/engine"
 	"github.com/rakyll/events2prom/event"
 
@@ -40,34 +41,60 @@ func main() {
 	}
 
 	events := make(chan event.Event, 32*1024)
-	collections := make(chan engine.Collection, 32)
-	removals := make(chan string, 32)
 
-	loop := engine.NewLoop(conf.BufferSize, events, collections, removals)
+	loop := engine.NewLoop(conf.BufferSize, events, nil, nil)
 	loop.BufferFlushWindow = conf.Window
+	loop.DefaultTTL = conf.TTL
+	loop.MaxSeries = conf.MaxSeries
+	loop.Workers = conf.Workers
+	loop.ExternalLabels = conf.ExternalLabels
 
 	server := &eventsServer{port: conf.Port, events: events}
-	admin := &adminServer{collections: collections, removals: removals}
+	admin := &adminServer{loop: loop}
 	http.HandleFunc("/collections", func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case "POST":
 			admin.handlePost(w, r)
 		case "DELETE":
 			admin.handleDelete(w, r)
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 		}
 	})
-	http.Handle("/metrics", promhttp.HandlerFor(loop.Registry(), promhttp.HandlerOpts{}))
+	http.HandleFunc("/collections/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/collections/")
+		if name, ok := strings.CutSuffix(name, "/reset"); ok {
+			if r.Method != "POST" {
+				http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+				return
+			}
+			admin.handleReset(w, r, name)
+			return
+		}
+		switch r.Method {
+		case "PUT":
+			admin.handlePut(w, r, name)
+		case "PATCH":
+			admin.handlePatch(w, r, name)
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		}
+	})
+	http.Handle("/metrics", metricsHandler(loop.Gatherer()))
 	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintln(w, "ok")
 	})
 
+	go loop.Run()
+
 	// Register collections if any.
 	for _, col := range conf.Collections {
-		collections <- col
+		if err := loop.EnableCollection(context.Background(), col); err != nil {
+			log.Fatalf("Can't enable collection %q from the config: %v", col.Name, err)
+		}
 	}
 
 	go server.listenAndServe()
-	go loop.Run()
 
 	log.Printf("Listening to admin server at %q...", conf.Endpoint)
 	log.Fatal(http.ListenAndServe(conf.Endpoint, nil))
@@ -14,11 +14,20 @@
 package main
 
 import (
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
 	"github.com/rakyll/events2prom/engine"
 	"github.com/rakyll/events2prom/event"
 )
@@ -52,9 +61,65 @@ func (s *eventsServer) listenAndServe() {
 	}
 }
 
+// metricsHandler serves the metrics gathered by g in the format
+// negotiated with the scraper, gzip compressed if accepted, like
+// promhttp. Unlike promhttp, it writes the units of metrics in the
+// OpenMetrics format.
+func metricsHandler(g prometheus.Gatherer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mfs, err := g.Gather()
+		if err != nil {
+			log.Printf("Error gathering metrics: %v", err)
+			http.Error(w, "An error has occurred while serving metrics:\n\n"+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		format := expfmt.NegotiateIncludingOpenMetrics(r.Header)
+		w.Header().Set("Content-Type", string(format))
+
+		var out io.Writer = w
+		if acceptsGzip(r) {
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			defer gz.Close()
+			out = gz
+		}
+		// Once encoding started, an error can't be
+		// reported in the response, so it stops sending.
+		enc := expfmt.NewEncoder(out, format, expfmt.WithUnit())
+		for _, mf := range mfs {
+			if err := enc.Encode(mf); err != nil {
+				log.Printf("Error encoding metric family %q: %v", mf.GetName(), err)
+				return
+			}
+		}
+		if closer, ok := enc.(expfmt.Closer); ok {
+			if err := closer.Close(); err != nil {
+				log.Printf("Error encoding metrics: %v", err)
+			}
+		}
+	})
+}
+
+// acceptsGzip reports whether the Accept-Encoding
+// header of r accepts gzip with a non-zero quality.
+func acceptsGzip(r *http.Request) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(accepted, ";")
+		if strings.TrimSpace(coding) != "gzip" {
+			continue
+		}
+		q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if !ok {
+			return true
+		}
+		quality, err := strconv.ParseFloat(q, 64)
+		return err == nil && quality > 0
+	}
+	return false
+}
+
 type adminServer struct {
-	collections chan engine.Collection
-	removals    chan string
+	loop *engine.Loop
 }
 
 func (s *adminServer) handlePost(w http.ResponseWriter, r *http.Request) {
@@ -63,7 +128,9 @@ func (s *adminServer) handlePost(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	s.collections <- col
+	if err := s.loop.EnableCollection(r.Context(), col); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+	}
 }
 
 func (s *adminServer) handleDelete(w http.ResponseWriter, r *http.Request) {
@@ -74,5 +141,139 @@ func (s *adminServer) handleDelete(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	s.removals <- col.Name
+	if err := s.loop.DisableCollection(r.Context(), col.Name); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+	}
+}
+
+// handlePut replaces the collection with the given name. Its samples
+// are kept unless the reset query parameter is true.
+func (s *adminServer) handlePut(w http.ResponseWriter, r *http.Request, name string) {
+	var col engine.Collection
+	if err := json.NewDecoder(r.Body).Decode(&col); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.update(w, r, name, col)
+}
+
+// handlePatch applies a JSON merge patch (RFC 7386)
+// to the collection with the given name.
+func (s *adminServer) handlePatch(w http.ResponseWriter, r *http.Request, name string) {
+	var patch map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	reset, err := resetParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = s.loop.PatchCollection(r.Context(), name, func(col engine.Collection) (engine.Collection, error) {
+		b, err := json.Marshal(col)
+		if err != nil {
+			return engine.Collection{}, err
+		}
+		var doc map[string]interface{}
+		if err := json.Unmarshal(b, &doc); err != nil {
+			return engine.Collection{}, err
+		}
+		if b, err = json.Marshal(mergePatch(doc, patch)); err != nil {
+			return engine.Collection{}, err
+		}
+		var patched engine.Collection
+		if err := json.Unmarshal(b, &patched); err != nil {
+			return engine.Collection{}, err
+		}
+		if patched.Name == "" {
+			patched.Name = name
+		}
+		return patched, nil
+	}, reset)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+	}
+}
+
+func (s *adminServer) update(w http.ResponseWriter, r *http.Request, name string, col engine.Collection) {
+	if col.Name == "" {
+		col.Name = name
+	}
+	if col.Name != name {
+		http.Error(w, "collections can't be renamed", http.StatusBadRequest)
+		return
+	}
+	reset, err := resetParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.loop.UpdateCollection(r.Context(), col, reset); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+	}
+}
+
+// resetParam returns the reset query parameter of r,
+// whether to reset the samples of updated collections.
+func resetParam(r *http.Request) (bool, error) {
+	v := r.URL.Query().Get("reset")
+	if v == "" {
+		return false, nil
+	}
+	reset, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid reset: %v", err)
+	}
+	return reset, nil
+}
+
+// handleReset resets the samples of the collection with the given name
+// whose labels match all of the optional matchers in the request body,
+// e.g. {"matchers": ["region=\"us-east-1\""]}, or all of its samples.
+func (s *adminServer) handleReset(w http.ResponseWriter, r *http.Request, name string) {
+	var req struct {
+		Matchers []engine.LabelMatcher `json:"matchers"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.loop.ResetCollection(r.Context(), name, req.Matchers...); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+	}
+}
+
+// mergePatch applies patch to doc as a JSON merge patch.
+func mergePatch(doc, patch map[string]interface{}) map[string]interface{} {
+	if doc == nil {
+		doc = make(map[string]interface{})
+	}
+	for k, v := range patch {
+		if v == nil {
+			delete(doc, k)
+			continue
+		}
+		if p, ok := v.(map[string]interface{}); ok {
+			d, _ := doc[k].(map[string]interface{})
+			doc[k] = mergePatch(d, p)
+			continue
+		}
+		doc[k] = v
+	}
+	return doc
+}
+
+// errorStatus returns the HTTP status code of an error
+// returned by the loop when changing collections.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, engine.ErrCollectionExists), errors.Is(err, engine.ErrIncompatibleUpdate):
+		return http.StatusConflict
+	case errors.Is(err, engine.ErrCollectionNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadRequest
 }
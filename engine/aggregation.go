@@ -0,0 +1,134 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"fmt"
+	"sync"
+)
+
+var (
+	aggregationsMu sync.RWMutex
+	aggregations   = make(map[string]func(Collection) (Processor, error))
+)
+
+func init() {
+	RegisterAggregation("count", func(c Collection) (Processor, error) {
+		return NewCountProcessor(c), nil
+	})
+	RegisterAggregation("sum", func(c Collection) (Processor, error) {
+		return NewSumProcessor(c), nil
+	})
+	RegisterAggregation("gauge", func(c Collection) (Processor, error) {
+		if err := validateGauge(c); err != nil {
+			return nil, err
+		}
+		return NewGaugeProcessor(c), nil
+	})
+	RegisterAggregation("min", func(c Collection) (Processor, error) {
+		if err := validateReset(c); err != nil {
+			return nil, err
+		}
+		return NewMinProcessor(c), nil
+	})
+	RegisterAggregation("max", func(c Collection) (Processor, error) {
+		if err := validateReset(c); err != nil {
+			return nil, err
+		}
+		return NewMaxProcessor(c), nil
+	})
+	RegisterAggregation("avg", func(c Collection) (Processor, error) {
+		if err := validateReset(c); err != nil {
+			return nil, err
+		}
+		return NewAvgProcessor(c), nil
+	})
+	RegisterAggregation("rate", func(c Collection) (Processor, error) {
+		if err := validateRate(c); err != nil {
+			return nil, err
+		}
+		return NewRateProcessor(c), nil
+	})
+	RegisterAggregation("histogram", func(c Collection) (Processor, error) {
+		if err := validateHistogram(c); err != nil {
+			return nil, err
+		}
+		return NewHistogramProcessor(c), nil
+	})
+	RegisterAggregation("summary", func(c Collection) (Processor, error) {
+		if err := validateSummary(c); err != nil {
+			return nil, err
+		}
+		return NewSummaryProcessor(c), nil
+	})
+	RegisterAggregation("topk", func(c Collection) (Processor, error) {
+		if err := validateTopK(c); err != nil {
+			return nil, err
+		}
+		return NewTopKProcessor(c), nil
+	})
+	RegisterAggregation("slo", func(c Collection) (Processor, error) {
+		if err := validateSLO(c); err != nil {
+			return nil, err
+		}
+		return NewSLOProcessor(c), nil
+	})
+}
+
+// RegisterAggregation makes an aggregation available to collections
+// by name. The factory returns the processor of a collection with
+// the aggregation, or an error if the options of the collection are
+// invalid for the aggregation. Built-in aggregations are registered
+// the same way. Processors select the events of their collection with
+// Collection.Match, and may implement SamplesCopier and SamplesResetter.
+// They should export a single metric named after their collection.
+// It panics if the name is empty or already registered.
+func RegisterAggregation(name string, factory func(Collection) (Processor, error)) {
+	if name == "" || factory == nil {
+		panic("engine: aggregation with empty name or nil factory")
+	}
+	aggregationsMu.Lock()
+	defer aggregationsMu.Unlock()
+
+	if _, ok := aggregations[name]; ok {
+		panic(fmt.Sprintf("engine: aggregation %q registered twice", name))
+	}
+	aggregations[name] = factory
+}
+
+// newProcessor returns a new processor for the aggregation of c.
+func newProcessor(c Collection) (Processor, error) {
+	aggregationsMu.RLock()
+	factory, ok := aggregations[c.Aggregation]
+	aggregationsMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown aggregation %q", c.Aggregation)
+	}
+	p, err := factory(c)
+	if err == nil && p == nil {
+		err = fmt.Errorf("no processor for aggregation %q", c.Aggregation)
+	}
+	return p, err
+}
+
+// mustNewProcessor is like newProcessor but panics on errors.
+// It should only be called for collections already enabled.
+func mustNewProcessor(c Collection) Processor {
+	p, err := newProcessor(c)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
@@ -0,0 +1,135 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rakyll/events2prom/engine"
+	"github.com/rakyll/events2prom/event"
+	"github.com/stretchr/testify/assert"
+)
+
+// lastProcessor exports the value of the last event. It's
+// outside of engine, as aggregations registered by users are.
+type lastProcessor struct {
+	col  engine.Collection
+	desc *prometheus.Desc
+
+	mu    sync.Mutex
+	value float64
+}
+
+var (
+	_ engine.SamplesCopier   = &lastProcessor{}
+	_ engine.SamplesResetter = &lastProcessor{}
+)
+
+func (p *lastProcessor) Collection() engine.Collection { return p.col }
+
+func (p *lastProcessor) Handle(events []event.Event) {
+	for _, e := range events {
+		if e, ok := p.col.Match(e); ok {
+			p.mu.Lock()
+			p.value = e.Value
+			p.mu.Unlock()
+		}
+	}
+}
+
+func (p *lastProcessor) CopySamples(old engine.Processor) error {
+	o, ok := old.(*lastProcessor)
+	if !ok {
+		return errors.New("processor changed")
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	p.value = o.value
+	return nil
+}
+
+func (p *lastProcessor) ResetSamples(matchers []engine.LabelMatcher) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.value = 0
+}
+
+func (p *lastProcessor) Describe(ch chan<- *prometheus.Desc) {
+	ch <- p.desc
+}
+
+func (p *lastProcessor) Collect(ch chan<- prometheus.Metric) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ch <- prometheus.MustNewConstMetric(p.desc, prometheus.GaugeValue, p.value)
+}
+
+func init() {
+	engine.RegisterAggregation("test_last", func(c engine.Collection) (engine.Processor, error) {
+		if len(c.Labels) > 0 {
+			return nil, errors.New("labels are not supported")
+		}
+		return &lastProcessor{col: c, desc: prometheus.NewDesc(c.Name, c.Description, nil, nil)}, nil
+	})
+}
+
+func TestRegisterAggregation(t *testing.T) {
+	events := make(chan event.Event)
+	l := engine.NewLoop(1, events, nil, nil) // flushes every event
+	go l.Run()
+
+	ctx := context.Background()
+	col := engine.Collection{Name: "queue_depth_last", Aggregation: "test_last", Event: "queue_depth"}
+	assert.NoError(t, l.EnableCollection(ctx, col))
+	assert.Error(t, l.EnableCollection(ctx, engine.Collection{Name: "invalid", Aggregation: "test_last", Event: "queue_depth", Labels: []string{"queue"}}))
+	assert.Error(t, l.EnableCollection(ctx, engine.Collection{Name: "unknown", Aggregation: "test_first", Event: "queue_depth"}))
+
+	// Transforms are applied by Match.
+	col.Transform = &engine.Transform{From: "ms", To: "s"}
+	assert.NoError(t, l.UpdateCollection(ctx, col, false))
+	events <- event.Event{Name: "queue_depth", Value: 10}
+	events <- event.Event{Name: "queue_depth", Value: 5000}
+	events <- event.Event{Name: "queue_length", Value: 1}
+	// Run flushed the events before handling the next call.
+	_, err := l.Collection(ctx, col.Name)
+	assert.NoError(t, err)
+	assert.Equal(t, 5.0, gatherLast(t, l))
+
+	// Samples are copied on updates and reset.
+	col.Description = "Last queue depth."
+	assert.NoError(t, l.UpdateCollection(ctx, col, false))
+	assert.Equal(t, 5.0, gatherLast(t, l))
+	assert.NoError(t, l.ResetCollection(ctx, col.Name))
+	assert.Equal(t, 0.0, gatherLast(t, l))
+
+	assert.Panics(t, func() {
+		engine.RegisterAggregation("count", func(c engine.Collection) (engine.Processor, error) { return nil, nil })
+	})
+}
+
+func gatherLast(t *testing.T, l *engine.Loop) float64 {
+	mfs, err := l.Registry().Gather()
+	assert.NoError(t, err)
+	for _, mf := range mfs {
+		if mf.GetName() == "queue_depth_last" {
+			return mf.GetMetric()[0].GetGauge().GetValue()
+		}
+	}
+	t.Fatal("queue_depth_last is not gathered")
+	return 0
+}
@@ -0,0 +1,37 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewProcessor_invalid(t *testing.T) {
+	for _, c := range []Collection{
+		{Aggregation: "gauge", Mode: "mul"},
+		{Aggregation: "gauge", Mode: "sub"},
+		{Aggregation: "avg", Reset: "never"},
+		{Aggregation: "rate", RateOf: "bytes"},
+		{Aggregation: "histogram"},
+		{Aggregation: "summary", Quantiles: []float64{1.5}},
+		{Aggregation: "summary", Quantiles: []float64{math.NaN()}},
+		{Aggregation: "summary", RelativeAccuracy: math.NaN()},
+	} {
+		_, err := newProcessor(c)
+		assert.Error(t, err, c.Aggregation)
+	}
+}
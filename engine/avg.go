@@ -0,0 +1,117 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"maps"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rakyll/events2prom/event"
+)
+
+var _ Processor = &AvgProcessor{}
+
+type avgSample struct {
+	series
+	sum   float64
+	count uint64
+}
+
+type AvgProcessor struct {
+	col Collection
+
+	samples map[string]avgSample // published, see resetBuffer
+	buffer  resetBuffer[avgSample]
+
+	prometheusDesc *prometheus.Desc
+}
+
+func NewAvgProcessor(c Collection) *AvgProcessor {
+	return &AvgProcessor{
+		col:            c,
+		samples:        make(map[string]avgSample),
+		buffer:         resetBuffer[avgSample]{reset: c.Reset},
+		prometheusDesc: prometheus.NewDesc(c.metricName(), c.Description, c.Labels, c.ConstLabels),
+	}
+}
+
+func (p *AvgProcessor) Collection() Collection {
+	return p.col
+}
+
+func (p *AvgProcessor) Handle(events []event.Event) {
+	now := time.Now()
+	if len(events) == 0 && p.buffer.skip(p.samples, p.col.TTL, now) {
+		return // nothing to aggregate, reset or expire
+	}
+	samples := p.buffer.begin(p.samples)
+	p.buffer.expire(p.col.TTL, now)
+	for _, e := range events {
+		if e, ok := p.col.Match(e); ok {
+			key, labelVals, s, ok := lookupSample(samples, p.col, e)
+			if !ok {
+				s.labelValues = labelVals
+			}
+			s.sum += e.Value
+			s.count++
+			s.updated = now
+			p.buffer.set(key, s)
+		}
+	}
+	p.col.reportSeries(len(samples))
+	p.samples = p.buffer.publish()
+}
+
+func (p *AvgProcessor) CopySamples(old Processor) error {
+	o, err := updatedProcessor[*AvgProcessor](p, old)
+	if err != nil {
+		return err
+	}
+	// Samples being collected are reset anyway.
+	p.samples = maps.Clone(o.buffer.take(o.samples))
+	if p.samples == nil {
+		p.samples = make(map[string]avgSample)
+	}
+	p.buffer.replace(p.samples)
+	return nil
+}
+
+func (p *AvgProcessor) ResetSamples(matchers []LabelMatcher) {
+	// Samples taken by Collect are reset anyway.
+	p.samples = withoutMatching(p.buffer.take(p.samples), p.col.Labels, matchers)
+	p.col.reportSeries(len(p.samples))
+	p.buffer.replace(p.samples)
+}
+
+func (p *AvgProcessor) Describe(ch chan<- *prometheus.Desc) {
+	ch <- p.prometheusDesc
+}
+
+func (p *AvgProcessor) Collect(ch chan<- prometheus.Metric) {
+	samples, release := p.buffer.load()
+	defer release()
+	now := time.Now()
+	for _, sample := range samples {
+		if sample.isStale(p.col.TTL, now) {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(
+			p.prometheusDesc,
+			prometheus.GaugeValue,
+			sample.sum/float64(sample.count),
+			sample.labelValues...,
+		)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAvg(t *testing.T) {
+	limiter := newSeriesLimiter(0)
+	p := NewAvgProcessor(Collection{
+		Name:    "queue_depth_avg",
+		Event:   "queue_depth",
+		Labels:  []string{"queue"},
+		Reset:   resetOnScrape,
+		limiter: limiter,
+	})
+	p.Handle(queueDepthEvents)
+
+	s := p.samples["queue_a_"]
+	assert.Equal(t, s.sum/float64(s.count), 38.0/3)
+
+	ch := make(chan prometheus.Metric, 4)
+	p.Collect(ch)
+	assert.Len(t, ch, 2)
+	p.Collect(ch)
+	assert.Len(t, ch, 2, "samples should be reset by scrapes")
+	assert.Equal(t, limiter.total, 2, "series should only be reported by Handle")
+
+	// The next batch starts over and reports the series left.
+	p.Handle(nil)
+	assert.Empty(t, p.samples)
+	assert.Equal(t, limiter.total, 0)
+	p.Handle(nil)
+	assert.NotNil(t, p.buffer.snapshot.load(), "samples should be published")
+}
+
+func TestAvg_resetOnFlush(t *testing.T) {
+	p := NewAvgProcessor(Collection{
+		Name:   "queue_depth_avg",
+		Event:  "queue_depth",
+		Labels: []string{"queue"},
+		Reset:  resetOnFlush,
+	})
+	p.Handle(queueDepthEvents)
+	assert.Equal(t, p.samples["queue_b_"].sum, 5.0)
+
+	// Batches without events still reset samples.
+	p.Handle(nil)
+	assert.Empty(t, p.samples)
+	p.Handle(nil)
+	assert.Empty(t, p.buffer.snapshot.load())
+}
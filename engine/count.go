@@ -14,7 +14,8 @@
 package engine
 
 import (
-	"sync"
+	"maps"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rakyll/events2prom/event"
@@ -23,15 +24,16 @@ import (
 var _ Processor = &CountProcessor{}
 
 type countSample struct {
-	labelValues []string
-	count       uint64
+	series
+	count    uint64
+	exemplar prometheus.Exemplar // latest, if any
 }
 
 type CountProcessor struct {
 	col Collection
 
-	samplesMu sync.RWMutex // TODO(jbd): We can switch to atomics here.
-	samples   map[string]countSample
+	samples map[string]countSample // published, see doubleBuffer
+	buffer  doubleBuffer[countSample]
 
 	prometheusDesc *prometheus.Desc
 }
@@ -39,8 +41,8 @@ type CountProcessor struct {
 func NewCountProcessor(c Collection) *CountProcessor {
 	return &CountProcessor{
 		col:            c,
-		samples:        make(map[string]countSample, 64),
-		prometheusDesc: prometheus.NewDesc(c.Name, c.Description, c.Labels, nil),
+		samples:        make(map[string]countSample),
+		prometheusDesc: prometheus.NewDesc(c.metricName(), c.Description, c.Labels, c.ConstLabels),
 	}
 }
 
@@ -49,23 +51,48 @@ func (p *CountProcessor) Collection() Collection {
 }
 
 func (p *CountProcessor) Handle(events []event.Event) {
-	p.samplesMu.Lock()
-	defer p.samplesMu.Unlock()
-
+	now := time.Now()
+	if len(events) == 0 && !hasStale(p.samples, p.col.TTL, now) {
+		return // nothing to aggregate or expire
+	}
+	samples := p.buffer.begin()
+	p.buffer.expire(p.col.TTL, now)
 	for _, e := range events {
-		if isMatch(e, p.col.Event, p.col.Labels) {
-			key, labelVals := generateKeyLabelVals(p.col, e)
-			_, ok := p.samples[key]
+		if e, ok := p.col.Match(e); ok {
+			key, labelVals, s, ok := lookupSample(samples, p.col, e)
 			if !ok {
-				p.samples[key] = countSample{
-					labelValues: labelVals,
-				}
+				s = countSample{series: series{labelValues: labelVals}}
 			}
-			s := p.samples[key]
 			s.count++
-			p.samples[key] = s
+			s.updated = now
+			if ex, ok := exemplarOf(e, 1, now); ok {
+				s.exemplar = ex
+			}
+			p.buffer.set(key, s)
 		}
 	}
+	p.col.reportSeries(len(samples))
+	p.samples = p.buffer.publish()
+}
+
+func (p *CountProcessor) CopySamples(old Processor) error {
+	o, err := updatedProcessor[*CountProcessor](p, old)
+	if err != nil {
+		return err
+	}
+	p.samples = maps.Clone(o.samples)
+	p.buffer.replace(p.samples)
+	return nil
+}
+
+func (p *CountProcessor) ResetSamples(matchers []LabelMatcher) {
+	p.samples = withoutMatching(p.samples, p.col.Labels, matchers)
+	p.col.reportSeries(len(p.samples))
+	p.buffer.replace(p.samples)
+}
+
+func (p *CountProcessor) seriesKeys() []string {
+	return sampleKeys(p.samples)
 }
 
 func (p *CountProcessor) Describe(ch chan<- *prometheus.Desc) {
@@ -73,15 +100,22 @@ func (p *CountProcessor) Describe(ch chan<- *prometheus.Desc) {
 }
 
 func (p *CountProcessor) Collect(ch chan<- prometheus.Metric) {
-	p.samplesMu.RLock()
-	defer p.samplesMu.RUnlock()
-
-	for _, sample := range p.samples {
-		ch <- prometheus.MustNewConstMetric(
+	samples, release := p.buffer.load()
+	defer release()
+	now := time.Now()
+	for _, sample := range samples {
+		if sample.isStale(p.col.TTL, now) {
+			continue
+		}
+		m := prometheus.MustNewConstMetric(
 			p.prometheusDesc,
 			prometheus.CounterValue,
 			float64(sample.count),
 			sample.labelValues...,
 		)
+		if sample.exemplar.Labels != nil {
+			m = withExemplars(m, sample.exemplar)
+		}
+		ch <- m
 	}
 }
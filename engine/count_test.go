@@ -17,6 +17,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/rakyll/events2prom/event"
 	"github.com/stretchr/testify/assert"
 )
@@ -102,3 +104,55 @@ func BenchmarkCount(b *testing.B) {
 		})
 	}
 }
+
+func TestCount_ttl(t *testing.T) {
+	p := NewCountProcessor(Collection{
+		Name:   "request_count",
+		Event:  "request",
+		Labels: []string{"pod"},
+		TTL:    time.Minute,
+	})
+	p.Handle([]event.Event{
+		{Name: "request", Labels: map[string]string{"pod": "pod-1"}},
+		{Name: "request", Labels: map[string]string{"pod": "pod-2"}},
+	})
+
+	// pod-1 had no events in the last two minutes.
+	s := p.samples["pod_pod-1_"]
+	s.updated = s.updated.Add(-2 * time.Minute)
+	p.samples["pod_pod-1_"] = s
+
+	ch := make(chan prometheus.Metric, 2)
+	p.Collect(ch)
+	assert.Len(t, ch, 1)
+
+	p.Handle([]event.Event{
+		{Name: "request", Labels: map[string]string{"pod": "pod-2"}},
+	})
+	assert.NotContains(t, p.samples, "pod_pod-1_")
+	assert.Equal(t, p.samples["pod_pod-2_"].count, uint64(2))
+}
+
+func TestCount_exemplar(t *testing.T) {
+	p := NewCountProcessor(Collection{
+		Name:  "request_count",
+		Event: "request",
+	})
+	ts := time.Now().Add(-time.Second)
+	p.Handle([]event.Event{
+		{Name: "request", Exemplar: map[string]string{"trace_id": "a"}},
+		{Name: "request", Exemplar: map[string]string{"trace_id": "b"}, Timestamp: ts},
+		{Name: "request"},
+	})
+
+	ch := make(chan prometheus.Metric, 1)
+	p.Collect(ch)
+	var m dto.Metric
+	assert.NoError(t, (<-ch).Write(&m))
+
+	e := m.GetCounter().GetExemplar()
+	assert.Equal(t, m.GetCounter().GetValue(), 3.0)
+	assert.Equal(t, e.GetLabel()[0].GetValue(), "b")
+	assert.Equal(t, e.GetValue(), 1.0)
+	assert.True(t, e.GetTimestamp().AsTime().Equal(ts))
+}
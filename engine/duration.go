@@ -0,0 +1,88 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+)
+
+// jsonDuration is a duration encoded in JSON as a string such as
+// "5m", as in YAML. Numbers are still decoded as nanoseconds.
+type jsonDuration time.Duration
+
+func (d *jsonDuration) UnmarshalJSON(b []byte) error {
+	if !bytes.HasPrefix(bytes.TrimSpace(b), []byte(`"`)) {
+		return json.Unmarshal(b, (*time.Duration)(d))
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = jsonDuration(v)
+	return nil
+}
+
+func (d jsonDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func toJSONDurations(ds []time.Duration) []jsonDuration {
+	if ds == nil {
+		return nil
+	}
+	converted := make([]jsonDuration, len(ds))
+	for i, d := range ds {
+		converted[i] = jsonDuration(d)
+	}
+	return converted
+}
+
+func fromJSONDurations(ds []jsonDuration) []time.Duration {
+	if ds == nil {
+		return nil
+	}
+	converted := make([]time.Duration, len(ds))
+	for i, d := range ds {
+		converted[i] = time.Duration(d)
+	}
+	return converted
+}
+
+func (w *Window) UnmarshalJSON(b []byte) error {
+	type plain Window
+	var v struct {
+		plain
+		Size jsonDuration `json:"size,omitempty"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*w = Window(v.plain)
+	w.Size = time.Duration(v.Size)
+	return nil
+}
+
+func (w Window) MarshalJSON() ([]byte, error) {
+	type plain Window
+	return json.Marshal(struct {
+		plain
+		Size jsonDuration `json:"size,omitempty"`
+	}{plain(w), jsonDuration(w.Size)})
+}
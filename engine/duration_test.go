@@ -0,0 +1,72 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestDurations(t *testing.T) {
+	var fromYAML Collection
+	assert.NoError(t, yaml.Unmarshal([]byte(`
+name: latency
+event: latency
+max_age: 10m
+half_lives: [1m, 5m]
+burn_rate_windows: [1h]
+ttl: 5m
+window: {size: 1m}
+`), &fromYAML))
+	assert.Equal(t, fromYAML.MaxAge, 10*time.Minute)
+	assert.Equal(t, fromYAML.HalfLives, []time.Duration{time.Minute, 5 * time.Minute})
+	assert.Equal(t, fromYAML.BurnRateWindows, []time.Duration{time.Hour})
+	assert.Equal(t, fromYAML.TTL, 5*time.Minute)
+	assert.Equal(t, fromYAML.Window.Size, time.Minute)
+
+	var fromJSON Collection
+	assert.NoError(t, json.Unmarshal([]byte(`{
+		"name": "latency",
+		"event": "latency",
+		"max_age": "10m",
+		"half_lives": ["1m", "5m"],
+		"burn_rate_windows": ["1h"],
+		"ttl": "5m",
+		"window": {"size": "1m"}
+	}`), &fromJSON))
+	assert.Equal(t, fromJSON, fromYAML)
+
+	b, err := json.Marshal(fromJSON)
+	assert.NoError(t, err)
+	assert.JSONEq(t, string(b), `{
+		"name": "latency",
+		"event": "latency",
+		"max_age": "10m0s",
+		"half_lives": ["1m0s", "5m0s"],
+		"burn_rate_windows": ["1h0m0s"],
+		"ttl": "5m0s",
+		"window": {"size": "1m0s"}
+	}`)
+
+	// Nanoseconds are still accepted.
+	var fromNanos Collection
+	assert.NoError(t, json.Unmarshal([]byte(`{"ttl": 300000000000}`), &fromNanos))
+	assert.Equal(t, fromNanos.TTL, 5*time.Minute)
+
+	assert.Error(t, json.Unmarshal([]byte(`{"ttl": "5 minutes"}`), &fromNanos))
+}
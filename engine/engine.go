@@ -15,10 +15,22 @@ package engine
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"path"
+	"reflect"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
 	"github.com/rakyll/events2prom/event"
 )
 
@@ -26,44 +38,247 @@ import (
 
 const defaultBufferSize = 32 * 1024
 
+var (
+	// ErrCollectionExists is returned when enabling a collection
+	// with the name or the metric of an enabled collection.
+	ErrCollectionExists = errors.New("collection already exists")
+
+	// ErrCollectionNotFound is returned when a collection isn't enabled.
+	ErrCollectionNotFound = errors.New("collection not found")
+
+	// ErrIncompatibleUpdate is returned when updating a collection
+	// in a way that its samples can't be kept without a reset.
+	ErrIncompatibleUpdate = errors.New("incompatible update, reset required")
+)
+
+const (
+	resetOnFlush  = "flush"
+	resetOnScrape = "scrape"
+)
+
+// Processor aggregates the events of a collection. Handle is never
+// called concurrently with itself, but Collect may be called at any
+// time and should not block Handle. Handle should not retain
+// events, which are reused once it returns.
 type Processor interface {
 	prometheus.Collector
 	Handle(events []event.Event)
 	Collection() Collection
 }
 
+// SamplesCopier is implemented by processors that can keep
+// the samples of a collection when the collection is updated.
+// CopySamples is called before the processor handles events.
+type SamplesCopier interface {
+	// CopySamples copies the samples of old, the processor of the
+	// collection before the update, or returns why it can't.
+	CopySamples(old Processor) error
+}
+
+// SamplesResetter is implemented by processors that can reset
+// some of their samples while the collection stays enabled.
+// ResetSamples is never called concurrently with Handle.
+type SamplesResetter interface {
+	// ResetSamples removes the samples whose labels match
+	// all matchers, or all samples if there are no matchers.
+	ResetSamples(matchers []LabelMatcher)
+}
+
+// updatedProcessor returns old as a P if the samples of old
+// can be copied to p, the processor of the updated collection.
+func updatedProcessor[P Processor](p, old Processor) (P, error) {
+	c, oc := p.Collection(), old.Collection()
+	o, ok := old.(P)
+	switch {
+	case c.Aggregation != oc.Aggregation:
+		return o, fmt.Errorf("aggregation changed from %q to %q", oc.Aggregation, c.Aggregation)
+	case !slices.Equal(c.Labels, oc.Labels):
+		return o, errors.New("labels changed")
+	case !reflect.DeepEqual(c.Window, oc.Window):
+		return o, errors.New("window changed")
+	case !reflect.DeepEqual(c.Transform, oc.Transform):
+		return o, errors.New("transform changed")
+	case !ok:
+		return o, errors.New("processor changed")
+	}
+	return o, nil
+}
+
 type Collection struct {
-	Name        string    `json:"name,omitempty" yaml:"name,omitempty"`
-	Description string    `json:"description,omitempty" yaml:"description,omitempty"`
-	Aggregation string    `json:"aggregation,omitempty" yaml:"aggregation,omitempty"` // count, sum or histogram
-	Event       string    `json:"event,omitempty" yaml:"event,omitempty"`
-	Labels      []string  `json:"labels,omitempty" yaml:"labels,omitempty"`
-	Buckets     []float64 `json:"buckets,omitempty" yaml:"buckets,omitempty"` // only if aggregation is histogram, otherwise ignored
+	Name        string `json:"name,omitempty" yaml:"name,omitempty"`
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+	Aggregation string `json:"aggregation,omitempty" yaml:"aggregation,omitempty"` // count, sum, gauge, min, max, avg, rate, histogram, summary, topk, slo or registered with RegisterAggregation
+	Event       string `json:"event,omitempty" yaml:"event,omitempty"`             // exact name or a glob such as http_*_latency_ms
+
+	// EventRegex selects events by name with a regular expression
+	// instead of Event, e.g. http_(get|post)_latency_ms.
+	EventRegex *Regexp `json:"event_regex,omitempty" yaml:"event_regex,omitempty"`
+
+	// EventLabel is the name of the label to set to the event name
+	// before relabeling. Add it to Labels to export the event name.
+	EventLabel string `json:"event_label,omitempty" yaml:"event_label,omitempty"`
+
+	Labels []string `json:"-" yaml:"-"` // encoded as labels, see labelSpec
+
+	// LabelDefaults are the values of Labels for events missing them.
+	// Events missing a label without a default are not aggregated.
+	// In JSON and YAML, they are set in labels, e.g.
+	// labels: [pod, {name: region, default: unknown}]
+	LabelDefaults map[string]string `json:"-" yaml:"-"`
+
+	// ConstLabels are labels with fixed values added to all series.
+	ConstLabels map[string]string `json:"const_labels,omitempty" yaml:"const_labels,omitempty"`
+
+	// Relabel are the rules applied to the labels of events, in order,
+	// before they are matched against Labels and aggregated.
+	Relabel []RelabelConfig `json:"relabel_configs,omitempty" yaml:"relabel_configs,omitempty"`
+
+	// Filter selects the events to aggregate after relabeling.
+	// All events with the name Event are aggregated if nil.
+	Filter *Filter `json:"filter,omitempty" yaml:"filter,omitempty"`
+
+	// Transform converts event values before aggregation.
+	Transform *Transform `json:"transform,omitempty" yaml:"transform,omitempty"`
+
+	Buckets []float64 `json:"buckets,omitempty" yaml:"buckets,omitempty"` // only if aggregation is histogram, otherwise ignored
+
+	// LinearBuckets and ExponentialBuckets generate buckets in addition
+	// to Buckets, only if aggregation is histogram.
+	LinearBuckets      *LinearBuckets      `json:"linear_buckets,omitempty" yaml:"linear_buckets,omitempty"`
+	ExponentialBuckets *ExponentialBuckets `json:"exponential_buckets,omitempty" yaml:"exponential_buckets,omitempty"`
+
+	// Mode is how events update the gauge, only if aggregation is gauge:
+	// "set" (default) to set it to the event's value, or to add the
+	// value if it's a delta such as +5 or -3, and "add" to add all values.
+	Mode string `json:"mode,omitempty" yaml:"mode,omitempty"`
+
+	// NativeHistogram enables Prometheus native histograms, only if
+	// aggregation is histogram. Buckets are still exported as
+	// classic buckets to scrapers that don't negotiate protobuf.
+	NativeHistogram *NativeHistogram `json:"native_histogram,omitempty" yaml:"native_histogram,omitempty"`
+
+	// Summary options, only if aggregation is summary, otherwise ignored.
+	Quantiles        []float64     `json:"quantiles,omitempty" yaml:"quantiles,omitempty"`                 // defaults to 0.5, 0.9 and 0.99
+	RelativeAccuracy float64       `json:"relative_accuracy,omitempty" yaml:"relative_accuracy,omitempty"` // defaults to 0.01
+	MaxAge           time.Duration `json:"max_age,omitempty" yaml:"max_age,omitempty"`                     // quantiles are over all time if zero
+	AgeBuckets       int           `json:"age_buckets,omitempty" yaml:"age_buckets,omitempty"`             // defaults to 5
+
+	// Rate options, only if aggregation is rate, otherwise ignored.
+	HalfLives []time.Duration `json:"half_lives,omitempty" yaml:"half_lives,omitempty"` // defaults to 1m, 5m and 15m
+	RateOf    string          `json:"rate_of,omitempty" yaml:"rate_of,omitempty"`       // events (default) or value
+
+	// Top-K options, only if aggregation is topk, otherwise ignored.
+	K      int    `json:"k,omitempty" yaml:"k,omitempty"`             // defaults to 10
+	TopKOf string `json:"topk_of,omitempty" yaml:"topk_of,omitempty"` // events (default) or value
+
+	// SLO options, only if aggregation is slo, otherwise ignored.
+	Thresholds      []float64       `json:"thresholds,omitempty" yaml:"thresholds,omitempty"`               // events with values at or under a threshold are good for it, required
+	Objective       float64         `json:"objective,omitempty" yaml:"objective,omitempty"`                 // ratio of good events, e.g. 0.99, required
+	Errors          *Filter         `json:"errors,omitempty" yaml:"errors,omitempty"`                       // events that are never good, e.g. with status=~"5.."
+	BurnRateWindows []time.Duration `json:"burn_rate_windows,omitempty" yaml:"burn_rate_windows,omitempty"` // defaults to 5m, 1h and 6h
+
+	// TTL is how long a label set is exported after its last event.
+	// Label sets never expire if negative. Defaults to the loop's DefaultTTL.
+	TTL time.Duration `json:"ttl,omitempty" yaml:"ttl,omitempty"`
+
+	// MaxSeries is the max number of label sets to export. Once reached,
+	// events with new label sets are aggregated in an overflow series
+	// where all labels are "__overflow__". No limit if zero.
+	MaxSeries int `json:"max_series,omitempty" yaml:"max_series,omitempty"`
+
+	// Window limits the aggregation to recent events, only if
+	// aggregation is count, sum, min, max or histogram.
+	Window *Window `json:"window,omitempty" yaml:"window,omitempty"`
+
+	// Reset resets the value of each label set at every flush window
+	// ("flush") or after every scrape ("scrape"), only if aggregation
+	// is min, max or avg. Values are kept for all time if empty.
+	Reset string `json:"reset,omitempty" yaml:"reset,omitempty"`
+
+	limiter *seriesLimiter // limits series of all collections, set by Loop
+	window  *windowSeries  // limits series of sub-windows, set by WindowedProcessor
+}
+
+// Window is a time window to aggregate events in.
+// A tumbling window resets every Size, a sliding window
+// covers the last Size with a ring of Buckets sub-windows.
+type Window struct {
+	Type    string        `json:"type,omitempty" yaml:"type,omitempty"`       // tumbling (default) or sliding
+	Size    time.Duration `json:"size,omitempty" yaml:"size,omitempty"`       // required
+	Buckets int           `json:"buckets,omitempty" yaml:"buckets,omitempty"` // only if sliding, defaults to 10
+}
+
+// LinearBuckets are Count buckets, each Width wide,
+// where the first bucket's upper bound is Start.
+type LinearBuckets struct {
+	Start float64 `json:"start,omitempty" yaml:"start,omitempty"`
+	Width float64 `json:"width,omitempty" yaml:"width,omitempty"`
+	Count int     `json:"count,omitempty" yaml:"count,omitempty"`
+}
+
+// ExponentialBuckets are Count buckets, where the first bucket's
+// upper bound is Start and every next one is Factor times larger.
+type ExponentialBuckets struct {
+	Start  float64 `json:"start,omitempty" yaml:"start,omitempty"`
+	Factor float64 `json:"factor,omitempty" yaml:"factor,omitempty"`
+	Count  int     `json:"count,omitempty" yaml:"count,omitempty"`
+}
+
+type NativeHistogram struct {
+	BucketFactor  float64 `json:"bucket_factor,omitempty" yaml:"bucket_factor,omitempty"`   // defaults to 1.1
+	MaxBuckets    int     `json:"max_buckets,omitempty" yaml:"max_buckets,omitempty"`       // defaults to 160
+	ZeroThreshold float64 `json:"zero_threshold,omitempty" yaml:"zero_threshold,omitempty"` // defaults to 2^-128
 }
 
 type Loop struct {
-	processors map[string]Processor // access only in Run
-	allEvents  map[string]struct{}  // access only in Run
+	processors    map[string]Processor   // access only in Run
+	collections   map[string]Collection  // as enabled, by name, access only in Run
+	byEvent       map[string][]Processor // by exact event name, access only in Run
+	eventPatterns map[string]Collection  // by collection name, access only in Run
+	routes        map[string][]Processor // by event name when there are patterns, access only in Run
+	batches       map[Processor][]int32  // indexes in buffer of the events of the processors at flush, access only in Run
 
 	buffer            []event.Event // access only in Run
 	bufferIndex       int           // access only in Run
 	BufferFlushWindow time.Duration
-	maxBufferSize     int
+	DefaultTTL        time.Duration // for collections with no TTL
+	MaxSeries         int           // max number of series of all collections, no limit if zero
+	Workers           int           // max number of processors handling events concurrently, GOMAXPROCS if zero
+
+	// ExternalLabels are labels with fixed values added to all
+	// series gathered by Gatherer, unless a series already has them.
+	ExternalLabels map[string]string
+
+	limiter       *seriesLimiter
+	maxBufferSize int
 
 	incomingEvents <-chan event.Event
 	newCollections <-chan Collection
 	removals       <-chan string
+	ops            chan op
 
 	promRegistry *prometheus.Registry
+	collector    *processorsCollector
+	metrics      map[string]string // collection names by exported metric name, see Collection.exportedNames, access only in Run
+
+	unitsMu sync.RWMutex
+	units   map[string]string // by metric name
 }
 
 func NewLoop(bufferSize int, e <-chan event.Event, c <-chan Collection, r <-chan string) *Loop {
 	if bufferSize == 0 {
 		bufferSize = defaultBufferSize
 	}
+	collector := &processorsCollector{}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(seriesOverflows, labelDefaults, collector)
 	return &Loop{
-		processors: make(map[string]Processor),
-		allEvents:  make(map[string]struct{}),
+		processors:    make(map[string]Processor),
+		collections:   make(map[string]Collection),
+		byEvent:       make(map[string][]Processor),
+		eventPatterns: make(map[string]Collection),
+		routes:        make(map[string][]Processor),
+		batches:       make(map[Processor][]int32),
 
 		buffer:            make([]event.Event, bufferSize),
 		maxBufferSize:     bufferSize,
@@ -72,20 +287,32 @@ func NewLoop(bufferSize int, e <-chan event.Event, c <-chan Collection, r <-chan
 		incomingEvents:    e,
 		newCollections:    c,
 		removals:          r,
-		promRegistry:      prometheus.NewRegistry(),
+		ops:               make(chan op),
+		promRegistry:      registry,
+		collector:         collector,
+		metrics:           make(map[string]string),
+		units:             make(map[string]string),
 	}
 }
 
 func (l *Loop) Run() {
+	l.limiter = newSeriesLimiter(l.MaxSeries)
+
 	timer := time.NewTimer(l.BufferFlushWindow)
 	defer timer.Stop()
 
 	for {
 		select {
 		case c := <-l.newCollections:
-			l.enableCollection(c)
+			if err := l.enableCollection(c); err != nil {
+				log.Printf("Failed to enable %q: %v", c.Name, err)
+			}
 		case name := <-l.removals:
-			l.disableCollection(name)
+			if err := l.disableCollection(name); err != nil {
+				log.Printf("Failed to disable %q: %v", name, err)
+			}
+		case o := <-l.ops:
+			o.done <- o.apply()
 		case e := <-l.incomingEvents:
 			l.handleEvent(e)
 			if l.bufferIndex == l.maxBufferSize {
@@ -99,59 +326,337 @@ func (l *Loop) Run() {
 	}
 }
 
+// op is a change of the collections to apply in Run.
+type op struct {
+	apply func() error
+	done  chan error
+}
+
+// EnableCollection enables c, or returns why it can't be enabled.
+// It blocks until Run enables c or ctx is done. If ctx is done after
+// Run has received c, c may still be enabled.
+func (l *Loop) EnableCollection(ctx context.Context, c Collection) error {
+	return l.do(ctx, func() error { return l.enableCollection(c) })
+}
+
+// UpdateCollection replaces the enabled collection with the name of c
+// with c. The samples of the collection are kept unless reset is set,
+// and ErrIncompatibleUpdate is returned if c changes how they're kept,
+// e.g. the aggregation, the labels or the transform. It blocks until
+// Run updates the collection or ctx is done.
+func (l *Loop) UpdateCollection(ctx context.Context, c Collection, reset bool) error {
+	return l.do(ctx, func() error { return l.updateCollection(c, reset) })
+}
+
+// PatchCollection updates the enabled collection with the given name
+// with the collection patch returns given the collection, as it was
+// enabled or last updated, as UpdateCollection does. The collection
+// can't change between the two, as patch is called by Run, so patch
+// should return quickly and not call the methods of l. It shouldn't
+// modify the slices and maps of the collection it's given. It blocks
+// until Run updates the collection or ctx is done.
+func (l *Loop) PatchCollection(ctx context.Context, name string, patch func(Collection) (Collection, error), reset bool) error {
+	return l.do(ctx, func() error {
+		c, ok := l.collections[name]
+		if !ok {
+			return fmt.Errorf("%w: %q", ErrCollectionNotFound, name)
+		}
+		c, err := patch(c)
+		if err != nil {
+			return err
+		}
+		if c.Name != name {
+			return fmt.Errorf("collection %q can't be renamed to %q", name, c.Name)
+		}
+		return l.updateCollection(c, reset)
+	})
+}
+
+// Collection returns the enabled collection with the given name,
+// as it was enabled or last updated.
+func (l *Loop) Collection(ctx context.Context, name string) (Collection, error) {
+	var c Collection
+	err := l.do(ctx, func() error {
+		var ok bool
+		if c, ok = l.collections[name]; !ok {
+			return fmt.Errorf("%w: %q", ErrCollectionNotFound, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return Collection{}, err
+	}
+	return c, nil
+}
+
+// DisableCollection disables the collection with the given name.
+// It blocks until Run disables the collection or ctx is done.
+func (l *Loop) DisableCollection(ctx context.Context, name string) error {
+	return l.do(ctx, func() error { return l.disableCollection(name) })
+}
+
+// ResetCollection resets the samples of the enabled collection with
+// the given name whose labels match all matchers, or all of its samples
+// if there are no matchers, e.g. after a producer sent invalid values.
+// The collection stays enabled. It blocks until Run resets the samples
+// or ctx is done.
+func (l *Loop) ResetCollection(ctx context.Context, name string, matchers ...LabelMatcher) error {
+	return l.do(ctx, func() error { return l.resetCollection(name, matchers) })
+}
+
+func (l *Loop) do(ctx context.Context, apply func() error) error {
+	o := op{apply: apply, done: make(chan error, 1)}
+	select {
+	case l.ops <- o:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-o.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // enableCollection should only be called from Run.
-func (l *Loop) enableCollection(c Collection) {
-	name := c.Name
-	if name == "" {
-		log.Println("Failed to enable collection with empty name")
-		return
+func (l *Loop) enableCollection(c Collection) error {
+	if _, ok := l.processors[c.Name]; ok {
+		return fmt.Errorf("%w: %q", ErrCollectionExists, c.Name)
 	}
-	if c.Event == "" {
-		log.Println("Failed to enable collection with empty event")
-		return
+	p, err := l.newCollectionProcessor(c)
+	if err != nil {
+		return err
 	}
-	_, ok := l.processors[name]
-	if ok {
-		log.Printf("Failed to enable duplicated collection: %q", name)
-		return
+	if err := l.addProcessor(p); err != nil {
+		return err
 	}
+	l.collections[c.Name] = c
+	log.Printf("Enabled collection: %q", c.Name)
+	return nil
+}
 
-	var p Processor
-	switch c.Aggregation {
-	case "count":
-		p = NewCountProcessor(c)
-	case "sum":
-		p = NewSumProcessor(c)
-	case "gauge":
-		p = NewGaugeProcessor(c)
-	case "histogram":
-		if len(c.Buckets) == 0 {
-			log.Printf("Failed to enable %q with no buckets", c.Name)
-			return
+// updateCollection replaces the collection with the name of c. The
+// samples of the collection are copied over unless reset is set, and
+// ErrIncompatibleUpdate is returned if they can't be. It should only
+// be called from Run.
+func (l *Loop) updateCollection(c Collection, reset bool) error {
+	old, ok := l.processors[c.Name]
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrCollectionNotFound, c.Name)
+	}
+	p, err := l.newCollectionProcessor(c)
+	if err != nil {
+		return err
+	}
+	if !reset {
+		copier, ok := p.(SamplesCopier)
+		if !ok {
+			return fmt.Errorf("%w: %q aggregation can't copy samples", ErrIncompatibleUpdate, c.Aggregation)
+		}
+		if err := copier.CopySamples(old); err != nil {
+			return fmt.Errorf("%w: %v", ErrIncompatibleUpdate, err)
 		}
-		p = NewHistogramProcessor(c)
-	default:
-		log.Printf("Unknown aggregation (%q) for %q", c.Aggregation, c.Name)
 	}
 
-	l.processors[name] = p
-	l.promRegistry.MustRegister(p)
-	l.allEvents[c.Event] = struct{}{}
-	log.Printf("Enabled collection: %q", name)
+	l.removeProcessor(old)
+	if err := l.addProcessor(p); err != nil {
+		if err := l.addProcessor(old); err != nil {
+			panic(err) // it was added before
+		}
+		return err
+	}
+	l.collections[c.Name] = c
+	log.Printf("Updated collection: %q", c.Name)
+	return nil
 }
 
 // disableCollection should only be called from Run.
-func (l *Loop) disableCollection(name string) {
+func (l *Loop) disableCollection(name string) error {
 	p, ok := l.processors[name]
 	if !ok {
-		return
+		return fmt.Errorf("%w: %q", ErrCollectionNotFound, name)
 	}
-
-	delete(l.processors, name)
-	l.promRegistry.Unregister(p)
-	delete(l.allEvents, p.Collection().Event)
+	l.removeProcessor(p)
+	delete(l.collections, name)
 
 	log.Printf("Disabled collection: %q", name)
+	return nil
+}
+
+// resetCollection should only be called from Run.
+func (l *Loop) resetCollection(name string, matchers []LabelMatcher) error {
+	p, ok := l.processors[name]
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrCollectionNotFound, name)
+	}
+	c := p.Collection()
+	if err := (&Filter{Labels: matchers}).validate(); err != nil {
+		return err
+	}
+	for _, m := range matchers {
+		if !slices.Contains(c.Labels, m.Name) {
+			return fmt.Errorf("collection %q has no label %q", name, m.Name)
+		}
+	}
+	resetter, ok := p.(SamplesResetter)
+	if !ok {
+		return fmt.Errorf("%q aggregation can't reset samples", c.Aggregation)
+	}
+	resetter.ResetSamples(matchers)
+	log.Printf("Reset collection: %q %v", name, matchers)
+	return nil
+}
+
+// newCollectionProcessor validates c and returns its processor.
+func (l *Loop) newCollectionProcessor(c Collection) (Processor, error) {
+	if c.Name == "" {
+		return nil, errors.New("empty name")
+	}
+	if c.Event == "" && c.EventRegex == nil {
+		return nil, errors.New("empty event")
+	}
+	if c.Event != "" && c.EventRegex != nil {
+		return nil, errors.New("both event and event regex")
+	}
+	if _, err := path.Match(c.Event, ""); err != nil {
+		return nil, fmt.Errorf("invalid event pattern: %w", err)
+	}
+	for i, rule := range c.Relabel {
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("invalid relabel config #%d: %w", i, err)
+		}
+	}
+	if err := c.Filter.validate(); err != nil {
+		return nil, fmt.Errorf("invalid filter: %w", err)
+	}
+	for label := range c.ConstLabels {
+		if !model.LabelName(label).IsValid() {
+			return nil, fmt.Errorf("invalid const label %q", label)
+		}
+		for _, l := range c.Labels {
+			if l == label {
+				return nil, fmt.Errorf("const label %q also in labels", label)
+			}
+		}
+	}
+	if err := c.Transform.validate(); err != nil {
+		return nil, fmt.Errorf("invalid transform: %w", err)
+	}
+	if c.TTL == 0 {
+		c.TTL = l.DefaultTTL
+	}
+	if c.MaxSeries < 0 {
+		return nil, errors.New("negative max series")
+	}
+	c.limiter = l.limiter
+
+	p, err := newProcessor(c)
+	if err != nil {
+		return nil, err
+	}
+	if c.Window != nil {
+		if err := validateWindow(c); err != nil {
+			return nil, fmt.Errorf("invalid window: %w", err)
+		}
+		p = NewWindowedProcessor(c, mustNewProcessor)
+	}
+	return p, nil
+}
+
+// addProcessor registers p and routes the events of
+// its collection to it. It should only be called from Run.
+func (l *Loop) addProcessor(p Processor) error {
+	c := p.Collection()
+	// Check the descriptors of p, which aren't
+	// checked by the registry, see processorsCollector.
+	if err := prometheus.NewRegistry().Register(p); err != nil {
+		return err
+	}
+	names := c.exportedNames()
+	for _, name := range names {
+		if colName, ok := l.metrics[name]; ok {
+			return fmt.Errorf("%w: metric %q of collection %q", ErrCollectionExists, name, colName)
+		}
+	}
+	l.processors[c.Name] = p
+	for _, name := range names {
+		l.metrics[name] = c.Name
+	}
+	l.collector.publish(l.processors)
+	if c.isEventPattern() {
+		l.eventPatterns[c.Name] = c
+	} else {
+		l.byEvent[c.Event] = append(l.byEvent[c.Event], p)
+	}
+	l.routes = make(map[string][]Processor)
+	if u := c.unit(); u != "" {
+		l.unitsMu.Lock()
+		l.units[c.metricName()] = u
+		l.unitsMu.Unlock()
+	}
+	return nil
+}
+
+// exportedNames returns the names of the series exported for the
+// metrics of c, suffixed as their types are in any format. A name
+// exported by two collections would make the metrics inconsistent,
+// failing to gather all metrics.
+func (c Collection) exportedNames() []string {
+	name := c.metricName()
+	switch {
+	case c.Aggregation == "histogram":
+		return []string{name, name + "_bucket", name + "_sum", name + "_count"}
+	case c.Window != nil:
+		return []string{name} // gauges
+	}
+	switch c.Aggregation {
+	case "count":
+		return []string{name, name + "_total"}
+	case "sum", "gauge", "min", "max", "avg", "rate", "topk":
+		return []string{name}
+	case "summary":
+		return []string{name, name + "_sum", name + "_count"}
+	case "slo":
+		return []string{name + "_good_total", name + "_total", name + "_burn_rate"}
+	}
+	// Metrics of other aggregations may be of any type.
+	return []string{name, name + "_bucket", name + "_sum", name + "_count", name + "_total"}
+}
+
+// removeProcessor reverts addProcessor. It should only be called from Run.
+func (l *Loop) removeProcessor(p Processor) {
+	c := p.Collection()
+	delete(l.processors, c.Name)
+	for _, name := range c.exportedNames() {
+		delete(l.metrics, name)
+	}
+	l.collector.publish(l.processors)
+	l.unitsMu.Lock()
+	delete(l.units, c.metricName())
+	l.unitsMu.Unlock()
+	if l.limiter != nil {
+		l.limiter.report(c.Name, 0)
+	}
+	if _, ok := l.eventPatterns[c.Name]; ok {
+		delete(l.eventPatterns, c.Name)
+	} else {
+		// Other collections may still aggregate the same event.
+		ps := l.byEvent[c.Event]
+		for i := range ps {
+			if ps[i] == p {
+				ps = append(ps[:i:i], ps[i+1:]...)
+				break
+			}
+		}
+		if len(ps) == 0 {
+			delete(l.byEvent, c.Event)
+		} else {
+			l.byEvent[c.Event] = ps
+		}
+	}
+	l.routes = make(map[string][]Processor)
+	delete(l.batches, p)
 }
 
 // handleEvent should only be called from Run.
@@ -161,8 +666,7 @@ func (l *Loop) handleEvent(e event.Event) {
 		return
 	}
 	// Ignore incoming event if it's not currently collected.
-	_, ok := l.allEvents[e.Name]
-	if !ok {
+	if len(l.route(e.Name)) == 0 {
 		return
 	}
 
@@ -170,25 +674,211 @@ func (l *Loop) handleEvent(e event.Event) {
 	l.bufferIndex++
 }
 
+// maxRoutes is the max number of event names to
+// remember the processors of when there are patterns.
+const maxRoutes = 16 * 1024
+
+// route returns the processors of the collections of the event
+// with the given name. It should only be called from Run.
+func (l *Loop) route(name string) []Processor {
+	if len(l.eventPatterns) == 0 {
+		return l.byEvent[name]
+	}
+	ps, ok := l.routes[name]
+	if ok {
+		return ps
+	}
+	ps = append(ps, l.byEvent[name]...)
+	for colName, c := range l.eventPatterns {
+		if c.matchesEvent(name) {
+			ps = append(ps, l.processors[colName])
+		}
+	}
+	if len(l.routes) >= maxRoutes {
+		l.routes = make(map[string][]Processor)
+	}
+	l.routes[name] = ps
+	return ps
+}
+
 // flush should only be called from Run.
 func (l *Loop) flush(timer *time.Timer) {
 	timer.Reset(l.BufferFlushWindow)
-	events := l.buffer[:l.bufferIndex]
-	for _, p := range l.processors {
-		p.Handle(events)
+	for i, e := range l.buffer[:l.bufferIndex] {
+		for _, p := range l.route(e.Name) {
+			l.batches[p] = append(l.batches[p], int32(i))
+		}
+	}
+	// Processors with no events are still handled
+	// to let them expire their samples.
+	l.handleBatches()
+	for p, batch := range l.batches {
+		l.batches[p] = batch[:0]
 	}
 	log.Printf("Flushed %d events.", l.bufferIndex)
 	l.bufferIndex = 0
 }
 
+// handleBatches hands the batches to their processors, concurrently
+// if there are multiple workers. It should only be called from Run.
+func (l *Loop) handleBatches() {
+	workers := l.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > len(l.processors) {
+		workers = len(l.processors)
+	}
+	if workers <= 1 {
+		var events []event.Event
+		for _, p := range l.processors {
+			events = l.handleBatch(p, events)
+		}
+		return
+	}
+
+	ps := make(chan Processor)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			var events []event.Event
+			for p := range ps {
+				events = l.handleBatch(p, events)
+			}
+		}()
+	}
+	for _, p := range l.processors {
+		ps <- p
+	}
+	close(ps)
+	wg.Wait()
+}
+
+// handleBatch hands the batch of p to p, copying its events to
+// events unless it has all events in the buffer. It returns events
+// to be reused by the next call.
+func (l *Loop) handleBatch(p Processor, events []event.Event) []event.Event {
+	batch := l.batches[p]
+	if len(batch) == l.bufferIndex {
+		p.Handle(l.buffer[:l.bufferIndex])
+		return events
+	}
+	events = events[:0]
+	for _, i := range batch {
+		events = append(events, l.buffer[i])
+	}
+	p.Handle(events)
+	clear(events) // don't keep labels alive until the next flush
+	return events
+}
+
 func (l *Loop) Registry() *prometheus.Registry {
 	return l.promRegistry
 }
 
-func isMatch(e event.Event, name string, labels []string) bool {
-	if name != e.Name {
-		return false
+// Gatherer returns a gatherer of the metrics in Registry that also
+// sets the units of the metrics of collections with units, and adds
+// ExternalLabels to all series.
+func (l *Loop) Gatherer() prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		mfs, err := l.promRegistry.Gather()
+
+		l.unitsMu.RLock()
+		defer l.unitsMu.RUnlock()
+		for _, mf := range mfs {
+			if u, ok := l.units[mf.GetName()]; ok {
+				mf.Unit = &u
+			}
+			if len(l.ExternalLabels) > 0 {
+				for _, m := range mf.Metric {
+					addExternalLabels(m, l.ExternalLabels)
+				}
+			}
+		}
+		return mfs, err
+	})
+}
+
+func addExternalLabels(m *dto.Metric, labels map[string]string) {
+	for name, value := range labels {
+		exists := false
+		for _, l := range m.Label {
+			if l.GetName() == name {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			name, value := name, value
+			m.Label = append(m.Label, &dto.LabelPair{Name: &name, Value: &value})
+		}
+	}
+	sort.Slice(m.Label, func(i, j int) bool {
+		return m.Label[i].GetName() < m.Label[j].GetName()
+	})
+}
+
+// isEventPattern reports whether c selects events
+// by a glob or a regex rather than by an exact name.
+func (c Collection) isEventPattern() bool {
+	return c.EventRegex != nil || strings.ContainsAny(c.Event, `*?[\`)
+}
+
+func (c Collection) matchesEvent(name string) bool {
+	switch {
+	case c.EventRegex != nil:
+		return c.EventRegex.MatchString(name)
+	case c.isEventPattern():
+		ok, _ := path.Match(c.Event, name)
+		return ok
+	}
+	return name == c.Event
+}
+
+// Match applies the relabeling rules, label defaults and transform
+// of c to e, and reports whether the resulting event should be
+// aggregated by c. Processors should aggregate only the events
+// returned by Match.
+func (c Collection) Match(e event.Event) (event.Event, bool) {
+	if !c.matchesEvent(e.Name) {
+		return e, false
+	}
+	if c.EventLabel != "" {
+		labels := make(map[string]string, len(e.Labels)+1)
+		for k, v := range e.Labels {
+			labels[k] = v
+		}
+		labels[c.EventLabel] = e.Name
+		e.Labels = labels
+	}
+	if len(c.Relabel) > 0 {
+		labels, ok := relabel(e.Labels, c.Relabel)
+		if !ok {
+			return e, false
+		}
+		e.Labels = labels
+	}
+	var defaulted []string
+	if len(c.LabelDefaults) > 0 {
+		e, defaulted = c.withLabelDefaults(e)
+	}
+	if !c.Filter.matches(e) || !hasLabels(e, c.Labels) {
+		return e, false
+	}
+	e.Value = c.Transform.apply(e.Value)
+	for _, name := range defaulted {
+		labelDefaults.WithLabelValues(c.Name, name).Inc()
 	}
+	return e, true
+}
+
+func isMatch(e event.Event, name string, labels []string) bool {
+	return name == e.Name && hasLabels(e, labels)
+}
+
+func hasLabels(e event.Event, labels []string) bool {
 	if len(e.Labels) < len(labels) {
 		return false
 	}
@@ -200,6 +890,70 @@ func isMatch(e event.Event, name string, labels []string) bool {
 	return true
 }
 
+// series is the state common to the samples of all processors.
+type series struct {
+	labelValues []string
+	updated     time.Time // last time an event was aggregated
+}
+
+func (s series) isStale(ttl time.Duration, now time.Time) bool {
+	return ttl > 0 && now.Sub(s.updated) > ttl
+}
+
+// matches reports whether the label values of s, the values of
+// labels, match all matchers.
+func (s series) matches(labels []string, matchers []LabelMatcher) bool {
+	for _, m := range matchers {
+		if !m.Matches(s.labelValues[slices.Index(labels, m.Name)]) {
+			return false
+		}
+	}
+	return true
+}
+
+// withoutMatching returns a copy of samples without the samples
+// whose labels match all matchers.
+func withoutMatching[S interface {
+	matches([]string, []LabelMatcher) bool
+}](samples map[string]S, labels []string, matchers []LabelMatcher) map[string]S {
+	kept := make(map[string]S)
+	for key, s := range samples {
+		if !s.matches(labels, matchers) {
+			kept[key] = s
+		}
+	}
+	return kept
+}
+
+// expire removes the samples that have no events for longer than ttl.
+func expire[S interface {
+	isStale(time.Duration, time.Time) bool
+}](samples map[string]S, ttl time.Duration, now time.Time) {
+	if ttl <= 0 {
+		return
+	}
+	for key, s := range samples {
+		if s.isStale(ttl, now) {
+			delete(samples, key)
+		}
+	}
+}
+
+// hasStale reports whether any of samples has no events for longer than ttl.
+func hasStale[S interface {
+	isStale(time.Duration, time.Time) bool
+}](samples map[string]S, ttl time.Duration, now time.Time) bool {
+	if ttl <= 0 {
+		return false
+	}
+	for _, s := range samples {
+		if s.isStale(ttl, now) {
+			return true
+		}
+	}
+	return false
+}
+
 func generateKeyLabelVals(col Collection, e event.Event) (key string, labelVals []string) {
 	labelVals = make([]string, len(col.Labels))
 	for i, label := range col.Labels {
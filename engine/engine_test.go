@@ -14,10 +14,18 @@
 package engine
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rakyll/events2prom/event"
+	"github.com/stretchr/testify/assert"
 )
 
 func BenchmarkIsMatch(b *testing.B) {
@@ -139,3 +147,423 @@ func TestIsMatch(t *testing.T) {
 		})
 	}
 }
+
+func TestEventPatterns(t *testing.T) {
+	regex := MustNewRegexp("http_(get|post)_latency_ms")
+	tests := []struct {
+		name string
+		col  Collection
+		want map[string]bool
+	}{
+		{
+			name: "exact",
+			col:  Collection{Event: "http_get_latency_ms"},
+			want: map[string]bool{"http_get_latency_ms": true, "http_post_latency_ms": false},
+		},
+		{
+			name: "glob",
+			col:  Collection{Event: "http_*_latency_ms"},
+			want: map[string]bool{"http_get_latency_ms": true, "http_post_latency_ms": true, "grpc_latency_ms": false},
+		},
+		{
+			name: "regex",
+			col:  Collection{EventRegex: &regex},
+			want: map[string]bool{"http_get_latency_ms": true, "http_put_latency_ms": false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, want := range tt.want {
+				assert.Equal(t, tt.col.matchesEvent(name), want, name)
+			}
+		})
+	}
+}
+
+func TestLoop_eventPatterns(t *testing.T) {
+	l := NewLoop(16, nil, nil, nil)
+	l.enableCollection(Collection{
+		Name:        "http_latency_ms",
+		Aggregation: "count",
+		Event:       "http_*_latency_ms",
+		EventLabel:  "event",
+		Labels:      []string{"event"},
+	})
+	l.handleEvent(event.Event{Name: "http_get_latency_ms"})
+	l.handleEvent(event.Event{Name: "http_post_latency_ms"})
+	l.handleEvent(event.Event{Name: "grpc_latency_ms"})
+	assert.Equal(t, l.bufferIndex, 2)
+
+	l.flush(newStoppedTimer())
+	p := l.processors["http_latency_ms"].(*CountProcessor)
+	assert.Equal(t, p.samples["event_http_get_latency_ms_"].count, uint64(1))
+	assert.Equal(t, p.samples["event_http_post_latency_ms_"].count, uint64(1))
+
+	l.disableCollection("http_latency_ms")
+	l.handleEvent(event.Event{Name: "http_get_latency_ms"})
+	assert.Equal(t, l.bufferIndex, 0)
+}
+
+func TestLoop_EnableCollection(t *testing.T) {
+	l := NewLoop(16, nil, nil, nil)
+	ctx := context.Background()
+
+	// Run is not running yet.
+	timeout, cancel := context.WithTimeout(ctx, time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, l.EnableCollection(timeout, Collection{}), context.DeadlineExceeded)
+
+	go l.Run()
+	col := Collection{Name: "requests", Aggregation: "count", Event: "request"}
+	assert.NoError(t, l.EnableCollection(ctx, col))
+	assert.ErrorIs(t, l.EnableCollection(ctx, col), ErrCollectionExists)
+
+	// Both are exported as request_latency_seconds.
+	assert.NoError(t, l.EnableCollection(ctx, Collection{Name: "request_latency_seconds", Aggregation: "sum", Event: "request"}))
+	col = Collection{Name: "request_latency", Aggregation: "sum", Event: "request", Transform: &Transform{From: "ns", To: "s"}}
+	assert.ErrorIs(t, l.EnableCollection(ctx, col), ErrCollectionExists)
+
+	// Series of histograms and counters are exported with suffixes.
+	assert.NoError(t, l.EnableCollection(ctx, Collection{Name: "lat", Aggregation: "histogram", Event: "request", Buckets: []float64{100}}))
+	assert.ErrorIs(t, l.EnableCollection(ctx, Collection{Name: "lat_count", Aggregation: "count", Event: "request"}), ErrCollectionExists)
+	assert.NoError(t, l.EnableCollection(ctx, Collection{Name: "req", Aggregation: "slo", Event: "request", Thresholds: []float64{100}, Objective: 0.99}))
+	assert.ErrorIs(t, l.EnableCollection(ctx, Collection{Name: "req_total", Aggregation: "sum", Event: "request"}), ErrCollectionExists)
+	assert.ErrorIs(t, l.EnableCollection(ctx, Collection{Name: "req_burn_rate", Aggregation: "max", Event: "request"}), ErrCollectionExists)
+	assert.ErrorIs(t, l.EnableCollection(ctx, Collection{Name: "requests_total", Aggregation: "gauge", Event: "request"}), ErrCollectionExists)
+
+	// Windowed counts are exported as gauges.
+	assert.NoError(t, l.EnableCollection(ctx, Collection{Name: "recent", Aggregation: "count", Event: "request", Window: &Window{Size: time.Minute}}))
+	assert.NoError(t, l.EnableCollection(ctx, Collection{Name: "recent_total", Aggregation: "sum", Event: "request"}))
+	_, err := l.Registry().Gather()
+	assert.NoError(t, err)
+
+	assert.Error(t, l.EnableCollection(ctx, Collection{Name: "requests_by_code", Aggregation: "median", Event: "request"}))
+
+	assert.NoError(t, l.DisableCollection(ctx, "requests"))
+	assert.ErrorIs(t, l.DisableCollection(ctx, "requests"), ErrCollectionNotFound)
+	assert.ErrorIs(t, l.DisableCollection(ctx, "requests_by_code"), ErrCollectionNotFound)
+}
+
+func TestLoop_updateCollection(t *testing.T) {
+	l := NewLoop(16, nil, nil, nil)
+	col := Collection{
+		Name:        "request_latency",
+		Aggregation: "histogram",
+		Event:       "request_latency",
+		Labels:      []string{"region"},
+		Buckets:     []float64{100, 200},
+	}
+	assert.NoError(t, l.enableCollection(col))
+	request := event.Event{Name: "request_latency", Labels: map[string]string{"region": "us-east-1"}, Value: 150}
+	l.handleEvent(request)
+	l.flush(newStoppedTimer())
+
+	// Buckets and TTL can change without losing samples.
+	col.Description = "Request latency in ms"
+	col.Buckets = []float64{100, 200, 400}
+	col.TTL = time.Hour
+	assert.NoError(t, l.updateCollection(col, false))
+	l.handleEvent(request)
+	l.flush(newStoppedTimer())
+	p := l.processors["request_latency"].(*HistogramProcessor)
+	assert.Equal(t, p.Collection().Description, "Request latency in ms")
+	assert.Equal(t, p.samples["region_us-east-1_"].histogram.Buckets(), map[float64]uint64{100: 0, 200: 2, 400: 2})
+
+	col.Labels = []string{"path", "region"}
+	assert.ErrorIs(t, l.updateCollection(col, false), ErrIncompatibleUpdate)
+	assert.Equal(t, l.processors["request_latency"], Processor(p))
+
+	col.Labels = []string{"region"}
+	col.Transform = &Transform{Scale: 1000}
+	assert.ErrorIs(t, l.updateCollection(col, false), ErrIncompatibleUpdate)
+	assert.Equal(t, l.processors["request_latency"], Processor(p))
+
+	assert.NoError(t, l.updateCollection(col, true))
+	assert.Empty(t, l.processors["request_latency"].(*HistogramProcessor).samples)
+
+	col.Name = "requests"
+	assert.ErrorIs(t, l.updateCollection(col, true), ErrCollectionNotFound)
+}
+
+func TestLoop_PatchCollection(t *testing.T) {
+	l := NewLoop(16, nil, nil, nil)
+	go l.Run()
+	ctx := context.Background()
+	assert.NoError(t, l.EnableCollection(ctx, Collection{Name: "requests", Aggregation: "count", Event: "request"}))
+
+	assert.NoError(t, l.PatchCollection(ctx, "requests", func(c Collection) (Collection, error) {
+		c.Description = "Requests"
+		return c, nil
+	}, false))
+	c, err := l.Collection(ctx, "requests")
+	assert.NoError(t, err)
+	assert.Equal(t, c.Description, "Requests")
+
+	patchErr := errors.New("invalid patch")
+	assert.ErrorIs(t, l.PatchCollection(ctx, "requests", func(c Collection) (Collection, error) {
+		return c, patchErr
+	}, false), patchErr)
+	assert.Error(t, l.PatchCollection(ctx, "requests", func(c Collection) (Collection, error) {
+		c.Name = "responses"
+		return c, nil
+	}, false))
+	assert.ErrorIs(t, l.PatchCollection(ctx, "responses", func(c Collection) (Collection, error) {
+		return c, nil
+	}, false), ErrCollectionNotFound)
+}
+
+func TestLoop_resetCollection(t *testing.T) {
+	l := NewLoop(16, nil, nil, nil)
+	assert.NoError(t, l.enableCollection(Collection{
+		Name:        "request_size",
+		Aggregation: "sum",
+		Event:       "request_size",
+		Labels:      []string{"region", "path"},
+	}))
+	for _, labels := range []map[string]string{
+		{"region": "us-east-1", "path": "/"},
+		{"region": "us-east-1", "path": "/health"},
+		{"region": "eu-west-1", "path": "/"},
+	} {
+		l.handleEvent(event.Event{Name: "request_size", Labels: labels, Value: 1e9})
+	}
+	l.flush(newStoppedTimer())
+
+	m, err := ParseLabelMatcher(`path!~"/health"`)
+	assert.NoError(t, err)
+	assert.NoError(t, l.resetCollection("request_size", []LabelMatcher{m, {Name: "region", Op: "=", Value: "us-east-1"}}))
+	p := l.processors["request_size"].(*SumProcessor)
+	samples, release := p.buffer.load()
+	assert.Len(t, samples, 2)
+	release()
+	assert.Contains(t, p.samples, "region_eu-west-1_path_/_")
+	assert.Contains(t, p.samples, "region_us-east-1_path_/health_")
+
+	assert.Error(t, l.resetCollection("request_size", []LabelMatcher{{Name: "status", Op: "=", Value: "500"}}))
+	assert.ErrorIs(t, l.resetCollection("request_count", nil), ErrCollectionNotFound)
+
+	assert.NoError(t, l.resetCollection("request_size", nil))
+	samples, release = p.buffer.load()
+	assert.Empty(t, samples)
+	release()
+}
+
+func TestLoop_sharedEvent(t *testing.T) {
+	l := NewLoop(16, nil, nil, nil)
+	l.enableCollection(Collection{Name: "request_count", Aggregation: "count", Event: "request"})
+	l.enableCollection(Collection{Name: "request_size", Aggregation: "sum", Event: "request"})
+	l.enableCollection(Collection{Name: "response_count", Aggregation: "count", Event: "response"})
+	l.disableCollection("request_count")
+
+	l.handleEvent(event.Event{Name: "request", Value: 10})
+	l.handleEvent(event.Event{Name: "response"})
+	l.handleEvent(event.Event{Name: "request", Value: 20})
+	assert.Equal(t, l.bufferIndex, 3)
+
+	l.flush(newStoppedTimer())
+	assert.Equal(t, l.processors["request_size"].(*SumProcessor).samples[""].sum, 30.0)
+	assert.Equal(t, l.processors["response_count"].(*CountProcessor).samples[""].count, uint64(1))
+}
+
+func TestLoop_workers(t *testing.T) {
+	for _, workers := range []int{1, 4} {
+		t.Run(fmt.Sprintf("workers=%d", workers), func(t *testing.T) {
+			l := NewLoop(64, nil, nil, nil)
+			l.Workers = workers
+			for i := 0; i < 8; i++ {
+				l.enableCollection(Collection{
+					Name:        fmt.Sprintf("request_size_%d", i),
+					Aggregation: "sum",
+					Event:       fmt.Sprintf("request_%d", i%4),
+				})
+			}
+			for i := 0; i < 64; i++ {
+				l.handleEvent(event.Event{Name: fmt.Sprintf("request_%d", i%4), Value: float64(i % 4)})
+			}
+			l.flush(newStoppedTimer())
+
+			for i := 0; i < 8; i++ {
+				p := l.processors[fmt.Sprintf("request_size_%d", i)].(*SumProcessor)
+				assert.Equal(t, p.samples[""].sum, float64(16*(i%4)))
+			}
+		})
+	}
+}
+
+func TestLoop_constLabels(t *testing.T) {
+	l := NewLoop(16, nil, nil, nil)
+	l.ExternalLabels = map[string]string{"node": "node-1", "region": "us-west-2"}
+	l.enableCollection(Collection{
+		Name:        "requests",
+		Aggregation: "count",
+		Event:       "request",
+		Labels:      []string{"code"},
+		ConstLabels: map[string]string{"region": "us-east-1"},
+	})
+	l.enableCollection(Collection{
+		Name:        "invalid",
+		Aggregation: "count",
+		Event:       "request",
+		Labels:      []string{"code"},
+		ConstLabels: map[string]string{"code": "200"},
+	})
+	assert.NotContains(t, l.processors, "invalid")
+
+	l.handleEvent(event.Event{Name: "request", Labels: map[string]string{"code": "200"}})
+	l.flush(newStoppedTimer())
+
+	mfs, err := l.Gatherer().Gather()
+	assert.NoError(t, err)
+	for _, mf := range mfs {
+		if mf.GetName() != "requests" {
+			continue
+		}
+		labels := map[string]string{}
+		for _, lp := range mf.GetMetric()[0].GetLabel() {
+			labels[lp.GetName()] = lp.GetValue()
+		}
+		assert.Equal(t, labels, map[string]string{"code": "200", "node": "node-1", "region": "us-east-1"})
+		return
+	}
+	t.Fatal("requests is not gathered")
+}
+
+func BenchmarkLoop_flush(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for _, n := range []int{1, 10, 200} {
+		b.Run(fmt.Sprintf("collections=%d", n), func(b *testing.B) {
+			l := NewLoop(1024, nil, nil, nil)
+			l.limiter = newSeriesLimiter(0)
+			for i := 0; i < n; i++ {
+				l.enableCollection(Collection{
+					Name:        fmt.Sprintf("request_latency_%d", i),
+					Aggregation: "sum",
+					Event:       fmt.Sprintf("request_latency_ms_%d", i),
+					Labels:      []string{"region"},
+				})
+			}
+			events := make([]event.Event, l.maxBufferSize)
+			for i := range events {
+				events[i] = event.Event{
+					Name:   fmt.Sprintf("request_latency_ms_%d", i%n),
+					Labels: map[string]string{"region": "us-east-1"},
+					Value:  1,
+				}
+			}
+			timer := newStoppedTimer()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for _, e := range events {
+					l.handleEvent(e)
+				}
+				l.flush(timer)
+			}
+		})
+	}
+}
+
+func TestLoop_scrapeWhileFlushing(t *testing.T) {
+	l := NewLoop(64, nil, nil, nil)
+	l.limiter = newSeriesLimiter(0)
+	for _, c := range []Collection{
+		{Aggregation: "count"},
+		{Aggregation: "sum"},
+		{Aggregation: "gauge"},
+		{Aggregation: "max", Reset: resetOnScrape},
+		{Aggregation: "avg"},
+		{Aggregation: "rate"},
+		{Aggregation: "histogram", Buckets: []float64{10, 100}},
+		{Aggregation: "summary", MaxAge: time.Millisecond},
+		{Aggregation: "sum", Window: &Window{Type: windowSliding, Size: time.Millisecond}},
+	} {
+		c.Name = fmt.Sprintf("request_latency_%d", len(l.processors))
+		c.Event = "request_latency"
+		c.Labels = []string{"region"}
+		l.enableCollection(c)
+	}
+	assert.Len(t, l.processors, 9)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			_, err := l.Gatherer().Gather()
+			assert.NoError(t, err)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		for j := 0; j < 64; j++ {
+			l.handleEvent(event.Event{
+				Name:   "request_latency",
+				Labels: map[string]string{"region": fmt.Sprintf("region-%d", j%4)},
+				Value:  float64(j),
+			})
+		}
+		l.flush(newStoppedTimer())
+	}
+	<-done
+}
+
+func BenchmarkLoop_flushWhileScraping(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	l := NewLoop(1024, nil, nil, nil)
+	l.limiter = newSeriesLimiter(0)
+	for i := 0; i < 10; i++ {
+		l.enableCollection(Collection{
+			Name:        fmt.Sprintf("request_latency_%d", i),
+			Aggregation: "histogram",
+			Event:       "request_latency_ms",
+			Labels:      []string{"path"},
+			Buckets:     prometheus.DefBuckets,
+		})
+	}
+	events := make([]event.Event, l.maxBufferSize)
+	for i := range events {
+		events[i] = event.Event{
+			Name:   "request_latency_ms",
+			Labels: map[string]string{"path": fmt.Sprintf("/%d", i)},
+			Value:  float64(i),
+		}
+	}
+	for _, e := range events {
+		l.handleEvent(e)
+	}
+	l.flush(newStoppedTimer())
+
+	done := make(chan struct{})
+	scraped := make(chan struct{})
+	go func() {
+		defer close(scraped)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				l.Gatherer().Gather()
+			}
+		}
+	}()
+	timer := newStoppedTimer()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, e := range events {
+			l.handleEvent(e)
+		}
+		l.flush(timer)
+	}
+	b.StopTimer()
+	close(done)
+	<-scraped
+}
+
+func newStoppedTimer() *time.Timer {
+	t := time.NewTimer(time.Hour)
+	t.Stop()
+	return t
+}
@@ -0,0 +1,102 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"sort"
+	"time"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/rakyll/events2prom/event"
+)
+
+// exemplarOf returns the exemplar of e with the given value, or false
+// if e has no exemplar or its labels can't be exposed. Exemplars
+// without a timestamp are timestamped at now.
+func exemplarOf(e event.Event, value float64, now time.Time) (prometheus.Exemplar, bool) {
+	if len(e.Exemplar) == 0 {
+		return prometheus.Exemplar{}, false
+	}
+	var runes int
+	for k, v := range e.Exemplar {
+		if !model.LabelName(k).IsValid() || !utf8.ValidString(v) {
+			return prometheus.Exemplar{}, false
+		}
+		runes += utf8.RuneCountInString(k) + utf8.RuneCountInString(v)
+	}
+	if runes > prometheus.ExemplarMaxRunes {
+		return prometheus.Exemplar{}, false
+	}
+	ts := e.Timestamp
+	if ts.IsZero() {
+		ts = now
+	}
+	return prometheus.Exemplar{Value: value, Labels: e.Exemplar, Timestamp: ts}, true
+}
+
+// bucketExemplars holds the latest exemplar of each bucket of a
+// histogram with the given upper bounds, and of the +Inf bucket.
+type bucketExemplars []prometheus.Exemplar
+
+// add sets ex as the exemplar of its bucket, allocating
+// the exemplars of all buckets if there are none yet.
+func (b bucketExemplars) add(buckets []float64, ex prometheus.Exemplar) bucketExemplars {
+	if b == nil {
+		b = make(bucketExemplars, len(buckets)+1)
+	}
+	b[sort.SearchFloat64s(buckets, ex.Value)] = ex
+	return b
+}
+
+// rebucket returns the exemplars of the buckets with the given
+// upper bounds, keeping the latest exemplar of each.
+func (b bucketExemplars) rebucket(buckets []float64) bucketExemplars {
+	var rebucketed bucketExemplars
+	for _, ex := range b {
+		if ex.Labels == nil {
+			continue
+		}
+		i := sort.SearchFloat64s(buckets, ex.Value)
+		if rebucketed == nil || rebucketed[i].Labels == nil || ex.Timestamp.After(rebucketed[i].Timestamp) {
+			rebucketed = rebucketed.add(buckets, ex)
+		}
+	}
+	return rebucketed
+}
+
+// list returns the exemplars of the buckets that have one.
+func (b bucketExemplars) list() []prometheus.Exemplar {
+	var exemplars []prometheus.Exemplar
+	for _, ex := range b {
+		if ex.Labels != nil {
+			exemplars = append(exemplars, ex)
+		}
+	}
+	return exemplars
+}
+
+// withExemplars returns m with the given exemplars,
+// or m if there are none or they can't be added.
+func withExemplars(m prometheus.Metric, exemplars ...prometheus.Exemplar) prometheus.Metric {
+	if len(exemplars) == 0 {
+		return m
+	}
+	em, err := prometheus.NewMetricWithExemplars(m, exemplars...)
+	if err != nil {
+		return m
+	}
+	return em
+}
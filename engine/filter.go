@@ -0,0 +1,244 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/rakyll/events2prom/event"
+)
+
+// Filter selects the events to aggregate. An event is
+// aggregated only if it matches all of Labels and Value.
+type Filter struct {
+	Labels []LabelMatcher   `json:"labels,omitempty" yaml:"labels,omitempty"` // e.g. status=~"5.." or route!="/health"
+	Value  []ValuePredicate `json:"value,omitempty" yaml:"value,omitempty"`   // e.g. "> 500"
+}
+
+// validate returns an error for the matchers and predicates that
+// are not created by NewLabelMatcher or the Parse functions.
+func (f *Filter) validate() error {
+	if f == nil {
+		return nil
+	}
+	for _, m := range f.Labels {
+		if _, err := NewLabelMatcher(m.Name, m.Op, m.Value); err != nil {
+			return err
+		}
+		if (m.Op == "=~" || m.Op == "!~") && m.regex.Regexp == nil {
+			return fmt.Errorf("label matcher %v is not compiled", m)
+		}
+	}
+	for _, p := range f.Value {
+		if _, err := ParseValuePredicate(p.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *Filter) matches(e event.Event) bool {
+	if f == nil {
+		return true
+	}
+	for _, m := range f.Labels {
+		if !m.Matches(e.Labels[m.Name]) {
+			return false
+		}
+	}
+	for _, p := range f.Value {
+		if !p.matches(e.Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// LabelMatcher matches the value of a label, similar to Prometheus
+// label matchers. It is decoded from strings such as status=~"5..".
+// A missing label matches as an empty value.
+type LabelMatcher struct {
+	Name  string
+	Op    string // =, !=, =~ or !~
+	Value string
+
+	regex Regexp // only if Op is =~ or !~
+}
+
+var labelMatcherOps = []string{"=~", "!~", "!=", "="}
+
+func NewLabelMatcher(name, op, value string) (LabelMatcher, error) {
+	m := LabelMatcher{Name: name, Op: op, Value: value}
+	switch op {
+	case "=", "!=":
+	case "=~", "!~":
+		r, err := NewRegexp(value)
+		if err != nil {
+			return LabelMatcher{}, err
+		}
+		m.regex = r
+	default:
+		return LabelMatcher{}, fmt.Errorf("unknown label matcher operator %q", op)
+	}
+	return m, nil
+}
+
+// ParseLabelMatcher parses a matcher such as status=~"5..".
+func ParseLabelMatcher(s string) (LabelMatcher, error) {
+	i := strings.IndexAny(s, "=!")
+	if i <= 0 {
+		return LabelMatcher{}, fmt.Errorf("invalid label matcher: %q", s)
+	}
+	name := strings.TrimSpace(s[:i])
+	for _, op := range labelMatcherOps {
+		if !strings.HasPrefix(s[i:], op) {
+			continue
+		}
+		value := strings.TrimSpace(s[i+len(op):])
+		if strings.HasPrefix(value, `"`) {
+			v, err := strconv.Unquote(value)
+			if err != nil {
+				return LabelMatcher{}, fmt.Errorf("invalid label matcher value: %q", s)
+			}
+			value = v
+		}
+		return NewLabelMatcher(name, op, value)
+	}
+	return LabelMatcher{}, fmt.Errorf("invalid label matcher: %q", s)
+}
+
+func (m LabelMatcher) String() string {
+	return m.Name + m.Op + strconv.Quote(m.Value)
+}
+
+// Matches reports whether the label value v matches m.
+func (m LabelMatcher) Matches(v string) bool {
+	switch m.Op {
+	case "=":
+		return v == m.Value
+	case "!=":
+		return v != m.Value
+	case "=~":
+		return m.regex.MatchString(v)
+	case "!~":
+		return !m.regex.MatchString(v)
+	}
+	return false
+}
+
+func (m *LabelMatcher) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	var err error
+	*m, err = ParseLabelMatcher(s)
+	return err
+}
+
+func (m LabelMatcher) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.String())
+}
+
+func (m *LabelMatcher) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	var err error
+	*m, err = ParseLabelMatcher(s)
+	return err
+}
+
+func (m LabelMatcher) MarshalYAML() (interface{}, error) {
+	return m.String(), nil
+}
+
+// ValuePredicate compares the value of an event to a number.
+// It is decoded from strings such as "> 500" or "!= 0".
+type ValuePredicate struct {
+	Op    string // ==, !=, <, <=, > or >=
+	Value float64
+}
+
+var valuePredicateOps = []string{"==", "!=", "<=", ">=", "<", ">"}
+
+// ParseValuePredicate parses a predicate such as "> 500".
+func ParseValuePredicate(s string) (ValuePredicate, error) {
+	s = strings.TrimSpace(s)
+	for _, op := range valuePredicateOps {
+		if !strings.HasPrefix(s, op) {
+			continue
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(s[len(op):]), 64)
+		if err != nil {
+			return ValuePredicate{}, fmt.Errorf("invalid value predicate: %q", s)
+		}
+		return ValuePredicate{Op: op, Value: v}, nil
+	}
+	return ValuePredicate{}, fmt.Errorf("invalid value predicate: %q", s)
+}
+
+func (p ValuePredicate) String() string {
+	return p.Op + " " + strconv.FormatFloat(p.Value, 'f', -1, 64)
+}
+
+func (p ValuePredicate) matches(v float64) bool {
+	switch p.Op {
+	case "==":
+		return v == p.Value
+	case "!=":
+		return v != p.Value
+	case "<":
+		return v < p.Value
+	case "<=":
+		return v <= p.Value
+	case ">":
+		return v > p.Value
+	case ">=":
+		return v >= p.Value
+	}
+	return false
+}
+
+func (p *ValuePredicate) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	var err error
+	*p, err = ParseValuePredicate(s)
+	return err
+}
+
+func (p ValuePredicate) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.String())
+}
+
+func (p *ValuePredicate) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	var err error
+	*p, err = ParseValuePredicate(s)
+	return err
+}
+
+func (p ValuePredicate) MarshalYAML() (interface{}, error) {
+	return p.String(), nil
+}
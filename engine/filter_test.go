@@ -0,0 +1,105 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/rakyll/events2prom/event"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestParseLabelMatcher(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    LabelMatcher
+		wantErr bool
+	}{
+		{in: `status="500"`, want: LabelMatcher{Name: "status", Op: "=", Value: "500"}},
+		{in: `route != "/health"`, want: LabelMatcher{Name: "route", Op: "!=", Value: "/health"}},
+		{in: `status=~5..`, want: LabelMatcher{Name: "status", Op: "=~", Value: "5.."}},
+		{in: `status!~"5.."`, want: LabelMatcher{Name: "status", Op: "!~", Value: "5.."}},
+		{in: `status=~"("`, wantErr: true},
+		{in: `=500`, wantErr: true},
+		{in: `status>500`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseLabelMatcher(tt.in)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, got.Name, tt.want.Name)
+			assert.Equal(t, got.Op, tt.want.Op)
+			assert.Equal(t, got.Value, tt.want.Value)
+		})
+	}
+}
+
+func TestFilter(t *testing.T) {
+	var c Collection
+	assert.NoError(t, yaml.Unmarshal([]byte(`
+name: slow_requests_total
+aggregation: count
+event: request
+labels: [route]
+filter:
+  labels: ['status!~"5.."', 'route!="/health"']
+  value: ['> 500']
+`), &c))
+	assert.NoError(t, c.Filter.validate())
+
+	p := NewCountProcessor(c)
+	p.Handle([]event.Event{
+		{Name: "request", Labels: map[string]string{"route": "/users", "status": "200"}, Value: 900},
+		{Name: "request", Labels: map[string]string{"route": "/users", "status": "200"}, Value: 100},
+		{Name: "request", Labels: map[string]string{"route": "/users", "status": "503"}, Value: 900},
+		{Name: "request", Labels: map[string]string{"route": "/health", "status": "200"}, Value: 900},
+	})
+	assert.Equal(t, p.samples["route_/users_"].count, uint64(1))
+	assert.Len(t, p.samples, 1)
+
+	b, err := json.Marshal(c.Filter)
+	assert.NoError(t, err)
+	assert.JSONEq(t, string(b), `{"labels":["status!~\"5..\"","route!=\"/health\""],"value":["> 500"]}`)
+}
+
+func TestFilter_invalid(t *testing.T) {
+	var f Filter
+	assert.Error(t, json.Unmarshal([]byte(`{"value": [">> 5"]}`), &f))
+	assert.Error(t, json.Unmarshal([]byte(`{"labels": ["status=~\"(\""]}`), &f))
+
+	f = Filter{Labels: []LabelMatcher{{Name: "status", Op: "=~", Value: "5.."}}}
+	assert.Error(t, f.validate())
+}
+
+func BenchmarkFilter(b *testing.B) {
+	var f Filter
+	if err := json.Unmarshal([]byte(`{"labels": ["status=~\"5..\"", "route!=\"/health\""], "value": ["> 500"]}`), &f); err != nil {
+		b.Fatal(err)
+	}
+	e := event.Event{
+		Name:   "request",
+		Labels: map[string]string{"route": "/users", "status": "503"},
+		Value:  900,
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f.matches(e)
+	}
+}
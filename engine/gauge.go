@@ -14,7 +14,9 @@
 package engine
 
 import (
-	"sync"
+	"fmt"
+	"maps"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rakyll/events2prom/event"
@@ -22,25 +24,41 @@ import (
 
 var _ Processor = &GaugeProcessor{}
 
+const (
+	gaugeModeSet = "set" // events set the gauge to their value, or add it if a delta
+	gaugeModeAdd = "add" // events add their value to the gauge
+)
+
 type gaugeSample struct {
-	labelValues []string
-	value       float64
+	series
+	value float64
 }
 
 type GaugeProcessor struct {
 	col Collection
 
-	samplesMu sync.RWMutex
-	samples   map[string]gaugeSample
+	samples map[string]gaugeSample // published, see doubleBuffer
+	buffer  doubleBuffer[gaugeSample]
 
 	prometheusDesc *prometheus.Desc
 }
 
+func validateGauge(c Collection) error {
+	switch c.Mode {
+	case "", gaugeModeSet, gaugeModeAdd:
+		return nil
+	}
+	return fmt.Errorf("unknown gauge mode %q", c.Mode)
+}
+
 func NewGaugeProcessor(c Collection) *GaugeProcessor {
+	if c.Mode == "" {
+		c.Mode = gaugeModeSet
+	}
 	return &GaugeProcessor{
 		col:            c,
-		samples:        make(map[string]gaugeSample, 64),
-		prometheusDesc: prometheus.NewDesc(c.Name, c.Description, c.Labels, nil),
+		samples:        make(map[string]gaugeSample),
+		prometheusDesc: prometheus.NewDesc(c.metricName(), c.Description, c.Labels, c.ConstLabels),
 	}
 }
 
@@ -49,18 +67,45 @@ func (p *GaugeProcessor) Collection() Collection {
 }
 
 func (p *GaugeProcessor) Handle(events []event.Event) {
-	p.samplesMu.Lock()
-	defer p.samplesMu.Unlock()
-
+	now := time.Now()
+	if len(events) == 0 && !hasStale(p.samples, p.col.TTL, now) {
+		return // nothing to aggregate or expire
+	}
+	samples := p.buffer.begin()
+	p.buffer.expire(p.col.TTL, now)
 	for _, e := range events {
-		if isMatch(e, p.col.Event, p.col.Labels) {
-			key, labelVals := generateKeyLabelVals(p.col, e)
-			p.samples[key] = gaugeSample{
-				labelValues: labelVals,
-				value:       e.Value,
+		if e, ok := p.col.Match(e); ok {
+			key, labelVals, s, ok := lookupSample(samples, p.col, e)
+			if !ok {
+				s.labelValues = labelVals
 			}
+			if e.Delta || p.col.Mode == gaugeModeAdd {
+				s.value += e.Value
+			} else {
+				s.value = e.Value
+			}
+			s.updated = now
+			p.buffer.set(key, s)
 		}
 	}
+	p.col.reportSeries(len(samples))
+	p.samples = p.buffer.publish()
+}
+
+func (p *GaugeProcessor) CopySamples(old Processor) error {
+	o, err := updatedProcessor[*GaugeProcessor](p, old)
+	if err != nil {
+		return err
+	}
+	p.samples = maps.Clone(o.samples)
+	p.buffer.replace(p.samples)
+	return nil
+}
+
+func (p *GaugeProcessor) ResetSamples(matchers []LabelMatcher) {
+	p.samples = withoutMatching(p.samples, p.col.Labels, matchers)
+	p.col.reportSeries(len(p.samples))
+	p.buffer.replace(p.samples)
 }
 
 func (p *GaugeProcessor) Describe(ch chan<- *prometheus.Desc) {
@@ -68,13 +113,16 @@ func (p *GaugeProcessor) Describe(ch chan<- *prometheus.Desc) {
 }
 
 func (p *GaugeProcessor) Collect(ch chan<- prometheus.Metric) {
-	p.samplesMu.RLock()
-	defer p.samplesMu.RUnlock()
-
-	for _, sample := range p.samples {
+	samples, release := p.buffer.load()
+	defer release()
+	now := time.Now()
+	for _, sample := range samples {
+		if sample.isStale(p.col.TTL, now) {
+			continue
+		}
 		ch <- prometheus.MustNewConstMetric(
 			p.prometheusDesc,
-			prometheus.CounterValue,
+			prometheus.GaugeValue,
 			sample.value,
 			sample.labelValues...,
 		)
@@ -17,6 +17,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/rakyll/events2prom/event"
 	"github.com/stretchr/testify/assert"
 )
@@ -66,3 +68,50 @@ func TestGauge(t *testing.T) {
 	assert.Equal(t,
 		p.samples["region_us-west-1_az_us-west-1c_"].value, 23.0)
 }
+
+var inflightEvents = []event.Event{
+	{Name: "inflight", Labels: map[string]string{"pod": "pod-1"}, Value: 5},
+	{Name: "inflight", Labels: map[string]string{"pod": "pod-1"}, Value: -3, Delta: true},
+	{Name: "inflight", Labels: map[string]string{"pod": "pod-2"}, Value: 2, Delta: true},
+	{Name: "inflight", Labels: map[string]string{"pod": "pod-2"}, Value: 4},
+}
+
+func TestGauge_modes(t *testing.T) {
+	tests := []struct {
+		mode string
+		want map[string]float64
+	}{
+		{mode: "", want: map[string]float64{"pod_pod-1_": 2, "pod_pod-2_": 4}},
+		{mode: gaugeModeSet, want: map[string]float64{"pod_pod-1_": 2, "pod_pod-2_": 4}},
+		{mode: gaugeModeAdd, want: map[string]float64{"pod_pod-1_": 2, "pod_pod-2_": 6}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			p := NewGaugeProcessor(Collection{
+				Name:   "inflight_requests",
+				Event:  "inflight",
+				Labels: []string{"pod"},
+				Mode:   tt.mode,
+			})
+			p.Handle(inflightEvents)
+			for key, want := range tt.want {
+				assert.Equal(t, p.samples[key].value, want)
+			}
+		})
+	}
+}
+
+func TestGauge_metricType(t *testing.T) {
+	p := NewGaugeProcessor(Collection{
+		Name:  "inflight_requests",
+		Event: "inflight",
+	})
+	p.Handle(inflightEvents)
+
+	ch := make(chan prometheus.Metric, 1)
+	p.Collect(ch)
+	var m dto.Metric
+	assert.NoError(t, (<-ch).Write(&m))
+	assert.NotNil(t, m.Gauge)
+	assert.Nil(t, m.Counter)
+}
@@ -14,65 +14,180 @@
 package engine
 
 import (
+	"errors"
+	"maps"
+	"reflect"
+	"slices"
 	"sort"
-	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/rakyll/events2prom/engine/histogram"
 	"github.com/rakyll/events2prom/event"
 )
 
 var _ Processor = &HistogramProcessor{}
 
+const (
+	defaultNativeBucketFactor  = 1.1
+	defaultNativeMaxBuckets    = 160
+	defaultNativeZeroThreshold = prometheus.DefNativeHistogramZeroThreshold
+)
+
 type histogramSample struct {
-	histogram   *histogram.Histogram
-	labelValues []string
+	series
+	histogram *histogram.Histogram
+	native    *histogram.Native // nil unless native histograms are enabled
+	exemplars bucketExemplars   // nil until an event has an exemplar
+}
+
+func (s histogramSample) clone() histogramSample {
+	s.histogram = s.histogram.Clone()
+	if s.native != nil {
+		s.native = s.native.Clone()
+	}
+	s.exemplars = slices.Clone(s.exemplars)
+	return s
 }
 
 type HistogramProcessor struct {
 	col Collection
 
-	samplesMu sync.RWMutex
-	samples   map[string]histogramSample
+	samples map[string]histogramSample // published, see doubleBuffer
+	buffer  doubleBuffer[histogramSample]
 
 	prometheusDesc *prometheus.Desc
 }
 
+func validateHistogram(c Collection) error {
+	if b := c.LinearBuckets; b != nil && (b.Width <= 0 || b.Count <= 0) {
+		return errors.New("invalid linear buckets")
+	}
+	if b := c.ExponentialBuckets; b != nil && (b.Start <= 0 || b.Factor <= 1 || b.Count <= 0) {
+		return errors.New("invalid exponential buckets")
+	}
+	if len(histogramBuckets(c)) == 0 && c.NativeHistogram == nil {
+		return errors.New("no buckets")
+	}
+	if n := c.NativeHistogram; n != nil && (n.BucketFactor < 0 || (n.BucketFactor > 0 && n.BucketFactor <= 1) || n.MaxBuckets < 0 || n.ZeroThreshold < 0) {
+		return errors.New("invalid native histogram options")
+	}
+	return nil
+}
+
 func NewHistogramProcessor(c Collection) *HistogramProcessor {
-	sort.Float64s(c.Buckets)
+	c.Buckets = histogramBuckets(c)
+	if n := c.NativeHistogram; n != nil {
+		native := *n
+		if native.BucketFactor == 0 {
+			native.BucketFactor = defaultNativeBucketFactor
+		}
+		if native.MaxBuckets == 0 {
+			native.MaxBuckets = defaultNativeMaxBuckets
+		}
+		if native.ZeroThreshold == 0 {
+			native.ZeroThreshold = defaultNativeZeroThreshold
+		}
+		c.NativeHistogram = &native
+	}
 	return &HistogramProcessor{
 		col:            c,
-		samples:        make(map[string]histogramSample, 64),
-		prometheusDesc: prometheus.NewDesc(c.Name, c.Description, c.Labels, nil),
+		samples:        make(map[string]histogramSample),
+		prometheusDesc: prometheus.NewDesc(c.metricName(), c.Description, c.Labels, c.ConstLabels),
 	}
 }
 
+// histogramBuckets returns the sorted and deduplicated
+// buckets listed and generated in c.
+func histogramBuckets(c Collection) []float64 {
+	buckets := append([]float64{}, c.Buckets...)
+	if b := c.LinearBuckets; b != nil {
+		buckets = append(buckets, prometheus.LinearBuckets(b.Start, b.Width, b.Count)...)
+	}
+	if b := c.ExponentialBuckets; b != nil {
+		buckets = append(buckets, prometheus.ExponentialBuckets(b.Start, b.Factor, b.Count)...)
+	}
+	sort.Float64s(buckets)
+
+	deduped := buckets[:0]
+	for _, b := range buckets {
+		if len(deduped) == 0 || b != deduped[len(deduped)-1] {
+			deduped = append(deduped, b)
+		}
+	}
+	return deduped
+}
+
 func (p *HistogramProcessor) Collection() Collection {
 	return p.col
 }
 
 func (p *HistogramProcessor) Handle(events []event.Event) {
-	p.samplesMu.Lock()
-	defer p.samplesMu.Unlock()
-
+	now := time.Now()
+	if len(events) == 0 && !hasStale(p.samples, p.col.TTL, now) {
+		return // nothing to aggregate or expire
+	}
+	samples := p.buffer.begin()
+	p.buffer.expire(p.col.TTL, now)
 	for _, e := range events {
-		if isMatch(e, p.col.Event, p.col.Labels) {
-			key, labelVals := generateKeyLabelVals(p.col, e)
-			_, ok := p.samples[key]
+		if e, ok := p.col.Match(e); ok {
+			key, labelVals, s, ok := lookupSample(samples, p.col, e)
 			if !ok {
-				p.samples[key] = histogramSample{
-					histogram:   histogram.NewHistogram(p.col.Buckets),
-					labelValues: labelVals,
+				s = histogramSample{
+					series:    series{labelValues: labelVals},
+					histogram: histogram.NewHistogram(p.col.Buckets),
+				}
+				if n := p.col.NativeHistogram; n != nil {
+					s.native = histogram.NewNative(n.BucketFactor, n.MaxBuckets, n.ZeroThreshold)
 				}
+			} else if !p.buffer.isSet(key) {
+				// Published histograms are read by Collect.
+				s = s.clone()
+			}
+			s.updated = now
+			s.histogram.Add(e.Value)
+			if s.native != nil {
+				s.native.Add(e.Value)
 			}
-			hist := p.samples[key].histogram
-			hist.Add(e.Value)
-			p.samples[key] = histogramSample{
-				histogram:   hist,
-				labelValues: labelVals,
+			if ex, ok := exemplarOf(e, e.Value, now); ok {
+				s.exemplars = s.exemplars.add(p.col.Buckets, ex)
 			}
+			p.buffer.set(key, s)
 		}
 	}
+	p.col.reportSeries(len(samples))
+	p.samples = p.buffer.publish()
+}
+
+func (p *HistogramProcessor) CopySamples(old Processor) error {
+	o, err := updatedProcessor[*HistogramProcessor](p, old)
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(p.col.NativeHistogram, o.col.NativeHistogram) {
+		return errors.New("native histogram options changed")
+	}
+	p.samples = maps.Clone(o.samples)
+	if !slices.Equal(p.col.Buckets, o.col.Buckets) {
+		for key, s := range p.samples {
+			s.histogram = s.histogram.Rebucket(p.col.Buckets)
+			s.exemplars = s.exemplars.rebucket(p.col.Buckets)
+			p.samples[key] = s
+		}
+	}
+	p.buffer.replace(p.samples)
+	return nil
+}
+
+func (p *HistogramProcessor) ResetSamples(matchers []LabelMatcher) {
+	p.samples = withoutMatching(p.samples, p.col.Labels, matchers)
+	p.col.reportSeries(len(p.samples))
+	p.buffer.replace(p.samples)
+}
+
+func (p *HistogramProcessor) seriesKeys() []string {
+	return sampleKeys(p.samples)
 }
 
 func (p *HistogramProcessor) Describe(ch chan<- *prometheus.Desc) {
@@ -80,16 +195,79 @@ func (p *HistogramProcessor) Describe(ch chan<- *prometheus.Desc) {
 }
 
 func (p *HistogramProcessor) Collect(ch chan<- prometheus.Metric) {
-	p.samplesMu.RLock()
-	defer p.samplesMu.RUnlock()
-
-	for _, sample := range p.samples {
-		ch <- prometheus.MustNewConstHistogram(
+	samples, release := p.buffer.load()
+	defer release()
+	now := time.Now()
+	for _, sample := range samples {
+		if sample.isStale(p.col.TTL, now) {
+			continue
+		}
+		m := prometheus.MustNewConstHistogram(
 			p.prometheusDesc,
 			sample.histogram.Total(),
 			sample.histogram.Sum(),
 			sample.histogram.Buckets(),
 			sample.labelValues...,
 		)
+		m = withExemplars(m, sample.exemplars.list()...)
+		if sample.native != nil {
+			m = &nativeHistogramMetric{Metric: m, native: sample.native, classic: len(p.col.Buckets) > 0}
+		}
+		ch <- m
+	}
+}
+
+// nativeHistogramMetric adds native buckets to a classic histogram.
+// Scrapers negotiating protobuf see both, text scrapers only
+// see the classic buckets.
+type nativeHistogramMetric struct {
+	prometheus.Metric
+	native  *histogram.Native
+	classic bool // whether the classic histogram has buckets
+}
+
+func (m *nativeHistogramMetric) Write(out *dto.Metric) error {
+	if err := m.Metric.Write(out); err != nil {
+		return err
+	}
+	h := out.Histogram
+	n := m.native
+	schema := n.Schema()
+	zeroThreshold := n.ZeroThreshold()
+	zeroCount := n.ZeroCount()
+	count := n.Total()
+	h.SampleCount = &count
+	h.Schema = &schema
+	for _, b := range h.Bucket {
+		// Native histograms keep exemplars regardless of buckets.
+		if b.Exemplar != nil {
+			h.Exemplars = append(h.Exemplars, b.Exemplar)
+		}
+	}
+	if !m.classic {
+		// Exemplars add the +Inf bucket to histograms without buckets.
+		h.Bucket = nil
+	}
+	h.ZeroThreshold = &zeroThreshold
+	h.ZeroCount = &zeroCount
+
+	spans, deltas := n.PositiveSpans()
+	h.PositiveSpan, h.PositiveDelta = toBucketSpans(spans), deltas
+	spans, deltas = n.NegativeSpans()
+	h.NegativeSpan, h.NegativeDelta = toBucketSpans(spans), deltas
+	if len(h.PositiveSpan) == 0 && len(h.NegativeSpan) == 0 && zeroCount == 0 {
+		// An empty span marks the histogram as native
+		// even if no observations were made yet.
+		h.PositiveSpan = []*dto.BucketSpan{{Offset: new(int32), Length: new(uint32)}}
+	}
+	return nil
+}
+
+func toBucketSpans(spans []histogram.Span) []*dto.BucketSpan {
+	out := make([]*dto.BucketSpan, len(spans))
+	for i, s := range spans {
+		offset, length := s.Offset, s.Length
+		out[i] = &dto.BucketSpan{Offset: &offset, Length: &length}
 	}
+	return out
 }
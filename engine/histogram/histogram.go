@@ -15,24 +15,49 @@ package histogram
 
 type Histogram struct {
 	buckets []float64
-	counts  []uint64
+	counts  []uint64 // last one is the +Inf bucket
 	sum     float64
 }
 
 func NewHistogram(b []float64) *Histogram {
 	return &Histogram{
 		buckets: b,
-		counts:  make([]uint64, len(b)),
+		counts:  make([]uint64, len(b)+1),
 	}
 }
 
-func (h *Histogram) Add(v float64) {
+// Clone returns a copy of h.
+func (h *Histogram) Clone() *Histogram {
+	c := *h
+	c.counts = append([]uint64(nil), h.counts...)
+	return &c
+}
+
+// Rebucket returns a copy of h with the given buckets. Values of
+// a bucket of h are counted in the first bucket not lower than it,
+// so counts are exact only if all the buckets are buckets of h.
+func (h *Histogram) Rebucket(buckets []float64) *Histogram {
+	r := NewHistogram(buckets)
+	r.sum = h.sum
+	j := 0
 	for i, b := range h.buckets {
-		if v <= b {
-			h.counts[i]++
+		for j < len(buckets) && buckets[j] < b {
+			j++
+		}
+		r.counts[j] += h.counts[i]
+	}
+	r.counts[len(buckets)] += h.counts[len(h.buckets)]
+	return r
+}
+
+func (h *Histogram) Add(v float64) {
+	i := 0
+	for ; i < len(h.buckets); i++ {
+		if v <= h.buckets[i] {
 			break
 		}
 	}
+	h.counts[i]++
 	h.sum += v
 }
 
@@ -46,6 +71,8 @@ func (h *Histogram) Buckets() map[float64]uint64 {
 	return m
 }
 
+// Total returns the number of all values added,
+// including the ones larger than the last bucket.
 func (h *Histogram) Total() uint64 {
 	var total uint64
 	for _, c := range h.counts {
@@ -47,6 +47,46 @@ func TestHistogram(t *testing.T) {
 	assert.Equal(t, h.Total(), uint64(1000))
 }
 
+func TestHistogram_outOfRange(t *testing.T) {
+	h := NewHistogram([]float64{100, 200})
+	for _, v := range []float64{-5, 50, 150, 250, 1e9} {
+		h.Add(v)
+	}
+	assert.Equal(t, h.Buckets(), map[float64]uint64{
+		100.0: 2,
+		200.0: 3,
+	})
+	assert.Equal(t, h.Total(), uint64(5))
+	assert.Equal(t, h.Sum(), 1e9+445)
+}
+
+func TestHistogram_noBuckets(t *testing.T) {
+	h := NewHistogram(nil)
+	h.Add(1)
+	assert.Empty(t, h.Buckets())
+	assert.Equal(t, h.Total(), uint64(1))
+}
+
+func TestHistogram_rebucket(t *testing.T) {
+	h := NewHistogram([]float64{100, 200, 300})
+	for _, v := range []float64{50, 150, 250, 350} {
+		h.Add(v)
+	}
+	// 150 is a new bucket, 200 is removed.
+	r := h.Rebucket([]float64{100, 150, 300})
+	assert.Equal(t, r.Buckets(), map[float64]uint64{
+		100.0: 1,
+		150.0: 1,
+		300.0: 3,
+	})
+	assert.Equal(t, r.Total(), uint64(4))
+	assert.Equal(t, r.Sum(), 800.0)
+
+	r = h.Rebucket([]float64{10})
+	assert.Equal(t, r.Buckets(), map[float64]uint64{10.0: 0})
+	assert.Equal(t, r.Total(), uint64(4))
+}
+
 func BenchmarkAdd(b *testing.B) {
 	h := NewHistogram([]float64{100, 200, 300, 400, 500, 600, 700, 800, 900, 1000})
 	b.ResetTimer()
@@ -0,0 +1,181 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package histogram
+
+import (
+	"maps"
+	"math"
+	"sort"
+)
+
+const (
+	minSchema = -4
+	maxSchema = 8
+)
+
+// Native is a sparse exponential histogram as defined by
+// Prometheus native histograms. The upper bound of bucket i
+// is 2^(i * 2^-schema).
+type Native struct {
+	schema        int32
+	zeroThreshold float64
+	maxBuckets    int
+
+	positive map[int]uint64
+	negative map[int]uint64
+	zero     uint64
+	count    uint64
+	sum      float64
+}
+
+// NewNative returns a native histogram with the highest resolution
+// where adjacent buckets grow by no more than factor. If maxBuckets
+// is positive, resolution is halved whenever more buckets than
+// maxBuckets are populated.
+func NewNative(factor float64, maxBuckets int, zeroThreshold float64) *Native {
+	return &Native{
+		schema:        SchemaForFactor(factor),
+		zeroThreshold: zeroThreshold,
+		maxBuckets:    maxBuckets,
+		positive:      make(map[int]uint64),
+		negative:      make(map[int]uint64),
+	}
+}
+
+// SchemaForFactor returns the largest schema whose
+// bucket growth factor is not larger than factor.
+func SchemaForFactor(factor float64) int32 {
+	if factor <= 1 {
+		return maxSchema
+	}
+	schema := int32(maxSchema)
+	for schema > minSchema && math.Exp2(math.Exp2(-float64(schema))) < factor {
+		schema--
+	}
+	if math.Exp2(math.Exp2(-float64(schema))) > factor && schema < maxSchema {
+		schema++
+	}
+	return schema
+}
+
+func (h *Native) Add(v float64) {
+	switch {
+	case v > h.zeroThreshold:
+		h.positive[h.index(v)]++
+	case v < -h.zeroThreshold:
+		h.negative[h.index(-v)]++
+	default:
+		h.zero++
+	}
+	h.count++
+	h.sum += v
+
+	for h.maxBuckets > 0 && len(h.positive)+len(h.negative) > h.maxBuckets && h.schema > minSchema {
+		h.positive = downscale(h.positive)
+		h.negative = downscale(h.negative)
+		h.schema--
+	}
+}
+
+// Clone returns a copy of h.
+func (h *Native) Clone() *Native {
+	c := *h
+	c.positive = maps.Clone(h.positive)
+	c.negative = maps.Clone(h.negative)
+	return &c
+}
+
+func (h *Native) Schema() int32 {
+	return h.schema
+}
+
+func (h *Native) ZeroThreshold() float64 {
+	return h.zeroThreshold
+}
+
+func (h *Native) ZeroCount() uint64 {
+	return h.zero
+}
+
+func (h *Native) Total() uint64 {
+	return h.count
+}
+
+func (h *Native) Sum() float64 {
+	return h.sum
+}
+
+// PositiveSpans returns the populated positive buckets
+// in the span and delta encoding used by Prometheus.
+func (h *Native) PositiveSpans() ([]Span, []int64) {
+	return spans(h.positive)
+}
+
+// NegativeSpans returns the populated negative buckets
+// in the span and delta encoding used by Prometheus.
+func (h *Native) NegativeSpans() ([]Span, []int64) {
+	return spans(h.negative)
+}
+
+// Span is a run of consecutive buckets. Offset is the gap
+// to the previous span, or the index of the first bucket
+// for the first span.
+type Span struct {
+	Offset int32
+	Length uint32
+}
+
+func (h *Native) index(v float64) int {
+	return int(math.Ceil(math.Log2(v) * math.Exp2(float64(h.schema))))
+}
+
+// downscale merges pairs of adjacent buckets, halving the resolution.
+func downscale(buckets map[int]uint64) map[int]uint64 {
+	m := make(map[int]uint64, len(buckets)/2+1)
+	for i, c := range buckets {
+		m[(i+1)>>1] += c
+	}
+	return m
+}
+
+func spans(buckets map[int]uint64) ([]Span, []int64) {
+	if len(buckets) == 0 {
+		return nil, nil
+	}
+	keys := make([]int, 0, len(buckets))
+	for k := range buckets {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+
+	var (
+		spans  []Span
+		deltas = make([]int64, 0, len(keys))
+		prev   int64
+	)
+	for i, k := range keys {
+		switch {
+		case i == 0:
+			spans = append(spans, Span{Offset: int32(k), Length: 1})
+		case k == keys[i-1]+1:
+			spans[len(spans)-1].Length++
+		default:
+			spans = append(spans, Span{Offset: int32(k - keys[i-1] - 1), Length: 1})
+		}
+		c := int64(buckets[k])
+		deltas = append(deltas, c-prev)
+		prev = c
+	}
+	return spans, deltas
+}
@@ -0,0 +1,62 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package histogram
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchemaForFactor(t *testing.T) {
+	assert.Equal(t, SchemaForFactor(1.1), int32(3))
+	assert.Equal(t, SchemaForFactor(2), int32(0))
+	assert.Equal(t, SchemaForFactor(1), int32(8))
+	assert.Equal(t, SchemaForFactor(1e6), int32(-4))
+}
+
+func TestNative(t *testing.T) {
+	h := NewNative(2, 0, 0.001)
+	for _, v := range []float64{0, 1, 2, 3, 4, 16, -1} {
+		h.Add(v)
+	}
+	assert.Equal(t, h.Schema(), int32(0))
+	assert.Equal(t, h.Total(), uint64(7))
+	assert.Equal(t, h.Sum(), 25.0)
+	assert.Equal(t, h.ZeroCount(), uint64(1))
+
+	spans, deltas := h.PositiveSpans()
+	// Buckets 0 (1), 1 (2), 2 (3, 4) and 4 (16).
+	assert.Equal(t, spans, []Span{{Offset: 0, Length: 3}, {Offset: 1, Length: 1}})
+	assert.Equal(t, deltas, []int64{1, 0, 1, -1})
+
+	spans, deltas = h.NegativeSpans()
+	assert.Equal(t, spans, []Span{{Offset: 0, Length: 1}})
+	assert.Equal(t, deltas, []int64{1})
+}
+
+func TestNative_maxBuckets(t *testing.T) {
+	h := NewNative(1.1, 4, 0.001)
+	for i := 1; i <= 1000; i++ {
+		h.Add(float64(i))
+	}
+	spans, _ := h.PositiveSpans()
+	var n uint32
+	for _, s := range spans {
+		n += s.Length
+	}
+	assert.LessOrEqual(t, n, uint32(4))
+	assert.Less(t, h.Schema(), int32(3))
+	assert.Equal(t, h.Total(), uint64(1000))
+}
@@ -0,0 +1,134 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rakyll/events2prom/event"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistogram_native(t *testing.T) {
+	p := NewHistogramProcessor(Collection{
+		Name:            "request_latency_ms",
+		Event:           "request_latency_ms",
+		Labels:          []string{"region"},
+		Buckets:         []float64{100},
+		NativeHistogram: &NativeHistogram{BucketFactor: 2},
+	})
+	p.Handle([]event.Event{
+		{Name: "request_latency_ms", Labels: map[string]string{"region": "us-east-1"}, Value: 3},
+		{Name: "request_latency_ms", Labels: map[string]string{"region": "us-east-1"}, Value: 4},
+	})
+
+	ch := make(chan prometheus.Metric, 1)
+	p.Collect(ch)
+	var m dto.Metric
+	assert.NoError(t, (<-ch).Write(&m))
+
+	h := m.GetHistogram()
+	assert.Equal(t, h.GetSampleCount(), uint64(2))
+	assert.Equal(t, h.GetSampleSum(), 7.0)
+	assert.Equal(t, h.GetBucket()[0].GetCumulativeCount(), uint64(2))
+	assert.Equal(t, h.GetSchema(), int32(0))
+	assert.Equal(t, h.GetPositiveSpan()[0].GetOffset(), int32(2))
+	assert.Equal(t, h.GetPositiveDelta(), []int64{2})
+	assert.Equal(t, m.GetLabel()[0].GetValue(), "us-east-1")
+}
+
+func TestHistogram_overflow(t *testing.T) {
+	p := NewHistogramProcessor(Collection{
+		Name:    "request_latency_ms",
+		Event:   "request_latency_ms",
+		Buckets: []float64{100},
+	})
+	p.Handle([]event.Event{
+		{Name: "request_latency_ms", Value: 50},
+		{Name: "request_latency_ms", Value: 5000},
+	})
+
+	ch := make(chan prometheus.Metric, 1)
+	p.Collect(ch)
+	var m dto.Metric
+	assert.NoError(t, (<-ch).Write(&m))
+
+	h := m.GetHistogram()
+	assert.Equal(t, h.GetSampleCount(), uint64(2))
+	assert.Equal(t, h.GetSampleSum(), 5050.0)
+	assert.Equal(t, h.GetBucket()[0].GetCumulativeCount(), uint64(1))
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	buckets := histogramBuckets(Collection{
+		Buckets:            []float64{1000, 10},
+		LinearBuckets:      &LinearBuckets{Start: 10, Width: 20, Count: 3},
+		ExponentialBuckets: &ExponentialBuckets{Start: 1, Factor: 10, Count: 4},
+	})
+	assert.Equal(t, buckets, []float64{1, 10, 30, 50, 100, 1000})
+}
+
+func TestHistogram_exemplars(t *testing.T) {
+	p := NewHistogramProcessor(Collection{
+		Name:    "request_latency_ms",
+		Event:   "request_latency_ms",
+		Buckets: []float64{100, 200},
+	})
+	p.Handle([]event.Event{
+		{Name: "request_latency_ms", Value: 50, Exemplar: map[string]string{"trace_id": "a"}},
+		{Name: "request_latency_ms", Value: 150, Exemplar: map[string]string{"trace_id": "b"}},
+		{Name: "request_latency_ms", Value: 160, Exemplar: map[string]string{"trace_id": "c"}},
+		{Name: "request_latency_ms", Value: 170},
+		{Name: "request_latency_ms", Value: 5000, Exemplar: map[string]string{"trace_id": "d"}},
+		{Name: "request_latency_ms", Value: 80, Exemplar: map[string]string{"trace_id": strings.Repeat("e", 200)}},
+	})
+
+	ch := make(chan prometheus.Metric, 1)
+	p.Collect(ch)
+	var m dto.Metric
+	assert.NoError(t, (<-ch).Write(&m))
+
+	buckets := m.GetHistogram().GetBucket()
+	assert.Len(t, buckets, 3)
+	for i, traceID := range []string{"a", "c", "d"} {
+		e := buckets[i].GetExemplar()
+		assert.Equal(t, e.GetLabel()[0].GetValue(), traceID)
+	}
+	assert.Equal(t, buckets[1].GetExemplar().GetValue(), 160.0)
+	assert.True(t, math.IsInf(buckets[2].GetUpperBound(), 1))
+}
+
+func TestHistogram_nativeExemplars(t *testing.T) {
+	p := NewHistogramProcessor(Collection{
+		Name:            "request_latency_ms",
+		Event:           "request_latency_ms",
+		NativeHistogram: &NativeHistogram{},
+	})
+	p.Handle([]event.Event{
+		{Name: "request_latency_ms", Value: 50, Exemplar: map[string]string{"trace_id": "a"}},
+	})
+
+	ch := make(chan prometheus.Metric, 1)
+	p.Collect(ch)
+	var m dto.Metric
+	assert.NoError(t, (<-ch).Write(&m))
+
+	h := m.GetHistogram()
+	assert.Empty(t, h.GetBucket())
+	assert.Equal(t, h.GetExemplars()[0].GetValue(), 50.0)
+}
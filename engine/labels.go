@@ -0,0 +1,178 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rakyll/events2prom/event"
+)
+
+var labelDefaults = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "events2prom_label_defaults_total",
+	Help: "Number of events aggregated with the default value of a missing label.",
+}, []string{"collection", "label"})
+
+// labelSpec is an element of the labels of a collection. It is either
+// a label name, or an object with a name and a default value used
+// for events that don't have the label.
+type labelSpec struct {
+	Name    string  `json:"name" yaml:"name"`
+	Default *string `json:"default,omitempty" yaml:"default,omitempty"`
+}
+
+func (l *labelSpec) UnmarshalJSON(b []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte(`"`)) {
+		*l = labelSpec{}
+		return json.Unmarshal(b, &l.Name)
+	}
+	type plain labelSpec
+	return json.Unmarshal(b, (*plain)(l))
+}
+
+func (l *labelSpec) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&l.Name); err == nil {
+		return nil
+	}
+	type plain labelSpec
+	return unmarshal((*plain)(l))
+}
+
+func (l labelSpec) MarshalJSON() ([]byte, error) {
+	if l.Default == nil {
+		return json.Marshal(l.Name)
+	}
+	type plain labelSpec
+	return json.Marshal(plain(l))
+}
+
+func (l labelSpec) MarshalYAML() (interface{}, error) {
+	if l.Default == nil {
+		return l.Name, nil
+	}
+	type plain labelSpec
+	return plain(l), nil
+}
+
+func (c Collection) labelSpecs() []labelSpec {
+	specs := make([]labelSpec, len(c.Labels))
+	for i, name := range c.Labels {
+		specs[i].Name = name
+		if v, ok := c.LabelDefaults[name]; ok {
+			specs[i].Default = &v
+		}
+	}
+	return specs
+}
+
+func (c *Collection) setLabelSpecs(specs []labelSpec) {
+	c.Labels = nil
+	c.LabelDefaults = nil
+	for _, s := range specs {
+		c.Labels = append(c.Labels, s.Name)
+		if s.Default != nil {
+			if c.LabelDefaults == nil {
+				c.LabelDefaults = make(map[string]string)
+			}
+			c.LabelDefaults[s.Name] = *s.Default
+		}
+	}
+}
+
+// Collections are decoded and encoded with custom methods so
+// labels can be listed either as names or as names with defaults,
+// and durations are strings in JSON as they are in YAML.
+
+type jsonCollection struct {
+	plainCollection
+	Labels          []labelSpec    `json:"labels,omitempty"`
+	MaxAge          jsonDuration   `json:"max_age,omitempty"`
+	HalfLives       []jsonDuration `json:"half_lives,omitempty"`
+	BurnRateWindows []jsonDuration `json:"burn_rate_windows,omitempty"`
+	TTL             jsonDuration   `json:"ttl,omitempty"`
+}
+
+type plainCollection Collection
+
+func (c *Collection) UnmarshalJSON(b []byte) error {
+	var v jsonCollection
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*c = Collection(v.plainCollection)
+	c.setLabelSpecs(v.Labels)
+	c.MaxAge = time.Duration(v.MaxAge)
+	c.HalfLives = fromJSONDurations(v.HalfLives)
+	c.BurnRateWindows = fromJSONDurations(v.BurnRateWindows)
+	c.TTL = time.Duration(v.TTL)
+	return nil
+}
+
+func (c Collection) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonCollection{
+		plainCollection: plainCollection(c),
+		Labels:          c.labelSpecs(),
+		MaxAge:          jsonDuration(c.MaxAge),
+		HalfLives:       toJSONDurations(c.HalfLives),
+		BurnRateWindows: toJSONDurations(c.BurnRateWindows),
+		TTL:             jsonDuration(c.TTL),
+	})
+}
+
+func (c *Collection) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Collection
+	var v struct {
+		plain  `yaml:",inline"`
+		Labels []labelSpec `yaml:"labels,omitempty"`
+	}
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+	*c = Collection(v.plain)
+	c.setLabelSpecs(v.Labels)
+	return nil
+}
+
+func (c Collection) MarshalYAML() (interface{}, error) {
+	type plain Collection
+	return struct {
+		plain  `yaml:",inline"`
+		Labels []labelSpec `yaml:"labels,omitempty"`
+	}{plain(c), c.labelSpecs()}, nil
+}
+
+// withLabelDefaults returns e with the default values of the
+// labels it is missing, and the names of these labels.
+// e is not modified.
+func (c Collection) withLabelDefaults(e event.Event) (event.Event, []string) {
+	var defaulted []string
+	for name, v := range c.LabelDefaults {
+		if _, ok := e.Labels[name]; ok {
+			continue
+		}
+		if defaulted == nil {
+			labels := make(map[string]string, len(e.Labels)+len(c.LabelDefaults))
+			for k, v := range e.Labels {
+				labels[k] = v
+			}
+			e.Labels = labels
+		}
+		e.Labels[name] = v
+		defaulted = append(defaulted, name)
+	}
+	return e, defaulted
+}
@@ -0,0 +1,81 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rakyll/events2prom/event"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestLabelSpecs(t *testing.T) {
+	var fromYAML Collection
+	assert.NoError(t, yaml.Unmarshal([]byte(`
+name: requests_by_region
+event: request
+labels: [pod, {name: region, default: unknown}, {name: az, default: ""}]
+buckets: [1, 2]
+`), &fromYAML))
+	assert.Equal(t, fromYAML.Labels, []string{"pod", "region", "az"})
+	assert.Equal(t, fromYAML.LabelDefaults, map[string]string{"region": "unknown", "az": ""})
+	assert.Equal(t, fromYAML.Buckets, []float64{1, 2})
+
+	var fromJSON Collection
+	assert.NoError(t, json.Unmarshal([]byte(`{
+		"name": "requests_by_region",
+		"event": "request",
+		"labels": ["pod", {"name": "region", "default": "unknown"}, {"name": "az", "default": ""}],
+		"buckets": [1, 2]
+	}`), &fromJSON))
+	assert.Equal(t, fromJSON, fromYAML)
+
+	b, err := json.Marshal(fromJSON)
+	assert.NoError(t, err)
+	assert.JSONEq(t, string(b), `{
+		"name": "requests_by_region",
+		"event": "request",
+		"labels": ["pod", {"name": "region", "default": "unknown"}, {"name": "az", "default": ""}],
+		"buckets": [1, 2]
+	}`)
+
+	b, err = yaml.Marshal(fromYAML)
+	assert.NoError(t, err)
+	var roundTrip Collection
+	assert.NoError(t, yaml.Unmarshal(b, &roundTrip))
+	assert.Equal(t, roundTrip, fromYAML)
+}
+
+func TestLabelDefaults(t *testing.T) {
+	p := NewCountProcessor(Collection{
+		Name:          "requests_by_region_with_defaults",
+		Event:         "request",
+		Labels:        []string{"pod", "region"},
+		LabelDefaults: map[string]string{"region": "unknown"},
+	})
+	p.Handle([]event.Event{
+		{Name: "request", Labels: map[string]string{"pod": "pod-1", "region": "us-east-1"}},
+		{Name: "request", Labels: map[string]string{"pod": "pod-1"}},
+		{Name: "request", Labels: map[string]string{"region": "us-east-1"}},
+	})
+	assert.Equal(t, p.samples["pod_pod-1_region_us-east-1_"].count, uint64(1))
+	assert.Equal(t, p.samples["pod_pod-1_region_unknown_"].count, uint64(1))
+	assert.Len(t, p.samples, 2)
+
+	defaulted := testutil.ToFloat64(labelDefaults.WithLabelValues("requests_by_region_with_defaults", "region"))
+	assert.Equal(t, defaulted, 1.0)
+}
@@ -0,0 +1,110 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rakyll/events2prom/event"
+)
+
+// overflowLabelValue is the value of all labels of the overflow
+// series, where new label sets are folded into once a series
+// limit is reached.
+const overflowLabelValue = "__overflow__"
+
+var seriesOverflows = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "events2prom_series_overflow_total",
+	Help: "Number of events folded into the overflow series because of a series limit.",
+}, []string{"collection"})
+
+// seriesLimiter limits the number of series of all collections.
+type seriesLimiter struct {
+	max int
+
+	mu     sync.Mutex
+	total  int
+	counts map[string]int // by collection name
+}
+
+func newSeriesLimiter(max int) *seriesLimiter {
+	return &seriesLimiter{
+		max:    max,
+		counts: make(map[string]int),
+	}
+}
+
+// report updates the number of series of a collection.
+func (l *seriesLimiter) report(collection string, n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.total += n - l.counts[collection]
+	if n == 0 {
+		delete(l.counts, collection)
+	} else {
+		l.counts[collection] = n
+	}
+}
+
+// isFull reports whether a collection currently
+// having n series can't add a new series.
+func (l *seriesLimiter) isFull(collection string, n int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.max > 0 && l.total-l.counts[collection]+n >= l.max
+}
+
+// isFull reports whether the collection having n series can't add
+// the series with the given key, as it reached its own limit or the
+// limit of all collections. Sub-windows are limited by their window.
+func (c Collection) isFull(key string, n int) bool {
+	if c.window != nil {
+		return !c.window.add(key)
+	}
+	if c.MaxSeries > 0 && n >= c.MaxSeries {
+		return true
+	}
+	return c.limiter != nil && c.limiter.isFull(c.Name, n)
+}
+
+// reportSeries reports the number of series of the
+// collection to the limiter of all collections, if any.
+func (c Collection) reportSeries(n int) {
+	if c.limiter != nil {
+		c.limiter.report(c.Name, n)
+	}
+}
+
+// lookupSample returns the key, the label values and the sample of e's
+// label set. If the label set is new and the collection is full,
+// the event is folded into the overflow series instead.
+func lookupSample[S any](samples map[string]S, c Collection, e event.Event) (key string, labelVals []string, s S, ok bool) {
+	key, labelVals = generateKeyLabelVals(c, e)
+	s, ok = samples[key]
+	if ok || !c.isFull(key, len(samples)) {
+		return key, labelVals, s, ok
+	}
+	seriesOverflows.WithLabelValues(c.Name).Inc()
+
+	labelVals = make([]string, len(c.Labels))
+	for i := range labelVals {
+		labelVals[i] = overflowLabelValue
+	}
+	key = generateKey(c.Labels, labelVals)
+	s, ok = samples[key]
+	return key, labelVals, s, ok
+}
@@ -0,0 +1,83 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rakyll/events2prom/event"
+	"github.com/stretchr/testify/assert"
+)
+
+func requestsByID(n int) []event.Event {
+	events := make([]event.Event, n)
+	for i := range events {
+		events[i] = event.Event{
+			Name:   "request",
+			Labels: map[string]string{"id": fmt.Sprint(i), "region": "us-east-1"},
+		}
+	}
+	return events
+}
+
+func TestMaxSeries(t *testing.T) {
+	p := NewCountProcessor(Collection{
+		Name:      "requests_by_id",
+		Event:     "request",
+		Labels:    []string{"id", "region"},
+		MaxSeries: 3,
+	})
+	before := testutil.ToFloat64(seriesOverflows.WithLabelValues("requests_by_id"))
+	p.Handle(requestsByID(10))
+
+	assert.Len(t, p.samples, 4)
+	assert.Equal(t, p.samples["id_2_region_us-east-1_"].count, uint64(1))
+	overflow := p.samples["id___overflow___region___overflow___"]
+	assert.Equal(t, overflow.count, uint64(7))
+	assert.Equal(t, overflow.labelValues, []string{overflowLabelValue, overflowLabelValue})
+
+	after := testutil.ToFloat64(seriesOverflows.WithLabelValues("requests_by_id"))
+	assert.Equal(t, after-before, 7.0)
+
+	// Existing label sets are still aggregated.
+	p.Handle(requestsByID(1))
+	assert.Equal(t, p.samples["id_0_region_us-east-1_"].count, uint64(2))
+}
+
+func TestMaxSeries_global(t *testing.T) {
+	limiter := newSeriesLimiter(5)
+	a := NewCountProcessor(Collection{
+		Name:    "requests_by_id_a",
+		Event:   "request",
+		Labels:  []string{"id"},
+		limiter: limiter,
+	})
+	b := NewSumProcessor(Collection{
+		Name:    "requests_by_id_b",
+		Event:   "request",
+		Labels:  []string{"id"},
+		limiter: limiter,
+	})
+	a.Handle(requestsByID(3))
+	b.Handle(requestsByID(3))
+
+	assert.Len(t, a.samples, 3)
+	assert.Len(t, b.samples, 3) // two series and the overflow series
+	assert.Contains(t, b.samples, "id___overflow___")
+
+	limiter.report("requests_by_id_a", 0)
+	assert.False(t, limiter.isFull("requests_by_id_b", 3))
+}
@@ -0,0 +1,143 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"fmt"
+	"maps"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rakyll/events2prom/event"
+)
+
+var _ Processor = &MinMaxProcessor{}
+
+type minMaxSample struct {
+	series
+	value float64
+}
+
+// MinMaxProcessor keeps the minimum or the maximum
+// value seen for each label set.
+type MinMaxProcessor struct {
+	col Collection
+	max bool
+
+	samples map[string]minMaxSample // published, see resetBuffer
+	buffer  resetBuffer[minMaxSample]
+
+	prometheusDesc *prometheus.Desc
+}
+
+// validateReset validates the reset of min, max and avg collections.
+func validateReset(c Collection) error {
+	switch c.Reset {
+	case "", resetOnFlush, resetOnScrape:
+		return nil
+	}
+	return fmt.Errorf("unknown reset %q", c.Reset)
+}
+
+func NewMinProcessor(c Collection) *MinMaxProcessor {
+	return newMinMaxProcessor(c, false)
+}
+
+func NewMaxProcessor(c Collection) *MinMaxProcessor {
+	return newMinMaxProcessor(c, true)
+}
+
+func newMinMaxProcessor(c Collection, max bool) *MinMaxProcessor {
+	return &MinMaxProcessor{
+		col:            c,
+		max:            max,
+		samples:        make(map[string]minMaxSample),
+		buffer:         resetBuffer[minMaxSample]{reset: c.Reset},
+		prometheusDesc: prometheus.NewDesc(c.metricName(), c.Description, c.Labels, c.ConstLabels),
+	}
+}
+
+func (p *MinMaxProcessor) Collection() Collection {
+	return p.col
+}
+
+func (p *MinMaxProcessor) Handle(events []event.Event) {
+	now := time.Now()
+	if len(events) == 0 && p.buffer.skip(p.samples, p.col.TTL, now) {
+		return // nothing to aggregate, reset or expire
+	}
+	samples := p.buffer.begin(p.samples)
+	p.buffer.expire(p.col.TTL, now)
+	for _, e := range events {
+		if e, ok := p.col.Match(e); ok {
+			key, labelVals, s, ok := lookupSample(samples, p.col, e)
+			if !ok {
+				s = minMaxSample{series: series{labelValues: labelVals}, value: e.Value}
+			}
+			if (p.max && e.Value > s.value) || (!p.max && e.Value < s.value) {
+				s.value = e.Value
+			}
+			s.updated = now
+			p.buffer.set(key, s)
+		}
+	}
+	p.col.reportSeries(len(samples))
+	p.samples = p.buffer.publish()
+}
+
+func (p *MinMaxProcessor) CopySamples(old Processor) error {
+	o, err := updatedProcessor[*MinMaxProcessor](p, old)
+	if err != nil {
+		return err
+	}
+	// Samples being collected are reset anyway.
+	p.samples = maps.Clone(o.buffer.take(o.samples))
+	if p.samples == nil {
+		p.samples = make(map[string]minMaxSample)
+	}
+	p.buffer.replace(p.samples)
+	return nil
+}
+
+func (p *MinMaxProcessor) ResetSamples(matchers []LabelMatcher) {
+	// Samples taken by Collect are reset anyway.
+	p.samples = withoutMatching(p.buffer.take(p.samples), p.col.Labels, matchers)
+	p.col.reportSeries(len(p.samples))
+	p.buffer.replace(p.samples)
+}
+
+func (p *MinMaxProcessor) seriesKeys() []string {
+	return sampleKeys(p.samples)
+}
+
+func (p *MinMaxProcessor) Describe(ch chan<- *prometheus.Desc) {
+	ch <- p.prometheusDesc
+}
+
+func (p *MinMaxProcessor) Collect(ch chan<- prometheus.Metric) {
+	samples, release := p.buffer.load()
+	defer release()
+	now := time.Now()
+	for _, sample := range samples {
+		if sample.isStale(p.col.TTL, now) {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(
+			p.prometheusDesc,
+			prometheus.GaugeValue,
+			sample.value,
+			sample.labelValues...,
+		)
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"testing"
+
+	"github.com/rakyll/events2prom/event"
+	"github.com/stretchr/testify/assert"
+)
+
+var queueDepthEvents = []event.Event{
+	{Name: "queue_depth", Labels: map[string]string{"queue": "a"}, Value: 10},
+	{Name: "queue_depth", Labels: map[string]string{"queue": "a"}, Value: -2},
+	{Name: "queue_depth", Labels: map[string]string{"queue": "a"}, Value: 30},
+	{Name: "queue_depth", Labels: map[string]string{"queue": "b"}, Value: 5},
+}
+
+func TestMin(t *testing.T) {
+	p := NewMinProcessor(Collection{
+		Name:   "queue_depth_min",
+		Event:  "queue_depth",
+		Labels: []string{"queue"},
+	})
+	p.Handle(queueDepthEvents)
+
+	assert.Equal(t, p.samples["queue_a_"].value, -2.0)
+	assert.Equal(t, p.samples["queue_b_"].value, 5.0)
+}
+
+func TestMax(t *testing.T) {
+	p := NewMaxProcessor(Collection{
+		Name:   "queue_depth_max",
+		Event:  "queue_depth",
+		Labels: []string{"queue"},
+		Reset:  resetOnFlush,
+	})
+	p.Handle(queueDepthEvents)
+
+	assert.Equal(t, p.samples["queue_a_"].value, 30.0)
+	assert.Equal(t, p.samples["queue_b_"].value, 5.0)
+
+	p.Handle(queueDepthEvents[:1])
+	assert.Equal(t, p.samples["queue_a_"].value, 10.0)
+	assert.NotContains(t, p.samples, "queue_b_")
+}
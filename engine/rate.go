@@ -0,0 +1,203 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rakyll/events2prom/event"
+)
+
+var _ Processor = &RateProcessor{}
+
+var defaultHalfLives = []time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute}
+
+const (
+	rateOfEvents = "events"
+	rateOfValue  = "value"
+)
+
+type rateSample struct {
+	series
+	rates   []float64 // per second, one for each half-life
+	ratesAt time.Time // time rates are decayed to
+}
+
+func (s rateSample) clone() rateSample {
+	s.rates = append([]float64(nil), s.rates...)
+	return s
+}
+
+// RateProcessor computes an exponentially-weighted moving average
+// of the rate of events, or the rate of their values, per second.
+// Each event contributes to the rate at its timestamp, or at the
+// time it is flushed if it has no timestamp.
+type RateProcessor struct {
+	col     Collection
+	decays  []float64 // ln(2)/half-life in seconds
+	windows []string
+
+	samples map[string]rateSample // published, see doubleBuffer
+	buffer  doubleBuffer[rateSample]
+	now     func() time.Time
+
+	prometheusDesc *prometheus.Desc
+}
+
+func validateRate(c Collection) error {
+	for _, h := range c.HalfLives {
+		if h <= 0 {
+			return fmt.Errorf("invalid half-life %v", h)
+		}
+	}
+	switch c.RateOf {
+	case "", rateOfEvents, rateOfValue:
+		return nil
+	}
+	return fmt.Errorf("unknown rate_of %q", c.RateOf)
+}
+
+func NewRateProcessor(c Collection) *RateProcessor {
+	if len(c.HalfLives) == 0 {
+		c.HalfLives = defaultHalfLives
+	}
+	if c.RateOf == "" {
+		c.RateOf = rateOfEvents
+	}
+	decays := make([]float64, len(c.HalfLives))
+	windows := make([]string, len(c.HalfLives))
+	for i, h := range c.HalfLives {
+		decays[i] = math.Ln2 / h.Seconds()
+		windows[i] = h.String()
+	}
+	labels := append(append([]string{}, c.Labels...), "half_life")
+	return &RateProcessor{
+		col:            c,
+		decays:         decays,
+		windows:        windows,
+		samples:        make(map[string]rateSample),
+		now:            time.Now,
+		prometheusDesc: prometheus.NewDesc(c.metricName(), c.Description, labels, c.ConstLabels),
+	}
+}
+
+func (p *RateProcessor) Collection() Collection {
+	return p.col
+}
+
+func (p *RateProcessor) Handle(events []event.Event) {
+	now := p.now()
+	if len(events) == 0 && !hasStale(p.samples, p.col.TTL, now) {
+		return // nothing to aggregate or expire
+	}
+	samples := p.buffer.begin()
+	p.buffer.expire(p.col.TTL, now)
+	for _, e := range events {
+		if e, ok := p.col.Match(e); ok {
+			key, labelVals, s, ok := lookupSample(samples, p.col, e)
+			if !ok {
+				s = rateSample{
+					series:  series{labelValues: labelVals},
+					rates:   make([]float64, len(p.decays)),
+					ratesAt: now,
+				}
+			} else if !p.buffer.isSet(key) {
+				// Published rates are read by Collect.
+				s = s.clone()
+			}
+			ts := e.Timestamp
+			if ts.IsZero() || ts.After(now) {
+				ts = now
+			}
+			weight := 1.0
+			if p.col.RateOf == rateOfValue {
+				weight = e.Value
+			}
+			p.observe(&s, ts, weight)
+			s.updated = now
+			p.buffer.set(key, s)
+		}
+	}
+	p.col.reportSeries(len(samples))
+	p.samples = p.buffer.publish()
+}
+
+// observe adds weight to the rates of s at time ts.
+// Observations older than the last update are decayed
+// as if they were added in order.
+func (p *RateProcessor) observe(s *rateSample, ts time.Time, weight float64) {
+	if ts.After(s.ratesAt) {
+		elapsed := ts.Sub(s.ratesAt).Seconds()
+		for i, d := range p.decays {
+			s.rates[i] *= math.Exp(-d * elapsed)
+		}
+		s.ratesAt = ts
+	}
+	age := s.ratesAt.Sub(ts).Seconds()
+	for i, d := range p.decays {
+		s.rates[i] += d * weight * math.Exp(-d*age)
+	}
+}
+
+func (p *RateProcessor) CopySamples(old Processor) error {
+	o, err := updatedProcessor[*RateProcessor](p, old)
+	if err != nil {
+		return err
+	}
+	if !slices.Equal(p.col.HalfLives, o.col.HalfLives) || p.col.RateOf != o.col.RateOf {
+		return errors.New("rate options changed")
+	}
+	p.samples = maps.Clone(o.samples)
+	p.buffer.replace(p.samples)
+	return nil
+}
+
+func (p *RateProcessor) ResetSamples(matchers []LabelMatcher) {
+	p.samples = withoutMatching(p.samples, p.col.Labels, matchers)
+	p.col.reportSeries(len(p.samples))
+	p.buffer.replace(p.samples)
+}
+
+func (p *RateProcessor) Describe(ch chan<- *prometheus.Desc) {
+	ch <- p.prometheusDesc
+}
+
+func (p *RateProcessor) Collect(ch chan<- prometheus.Metric) {
+	samples, release := p.buffer.load()
+	defer release()
+	now := p.now()
+	for _, sample := range samples {
+		if sample.isStale(p.col.TTL, now) {
+			continue
+		}
+		elapsed := now.Sub(sample.ratesAt).Seconds()
+		if elapsed < 0 {
+			elapsed = 0
+		}
+		for i, d := range p.decays {
+			ch <- prometheus.MustNewConstMetric(
+				p.prometheusDesc,
+				prometheus.GaugeValue,
+				sample.rates[i]*math.Exp(-d*elapsed),
+				append(sample.labelValues, p.windows[i])...,
+			)
+		}
+	}
+}
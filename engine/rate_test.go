@@ -0,0 +1,78 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rakyll/events2prom/event"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRate(t *testing.T) {
+	now := time.Now()
+	p := NewRateProcessor(Collection{
+		Name:      "requests_per_second",
+		Event:     "request",
+		Labels:    []string{"region"},
+		HalfLives: []time.Duration{time.Minute},
+	})
+	p.now = func() time.Time { return now }
+
+	// Ten events per second for ten minutes.
+	for i := 0; i < 600; i++ {
+		now = now.Add(time.Second)
+		var events []event.Event
+		for j := 0; j < 10; j++ {
+			events = append(events, event.Event{
+				Name:   "request",
+				Labels: map[string]string{"region": "us-east-1"},
+			})
+		}
+		p.Handle(events)
+	}
+	assert.InDelta(t, 10, p.samples["region_us-east-1_"].rates[0], 0.5)
+
+	// The rate halves after a half-life without events.
+	s := p.samples["region_us-east-1_"]
+	p.observe(&s, now.Add(time.Minute), 0)
+	assert.InDelta(t, 5, s.rates[0], 0.25)
+}
+
+func TestRate_value(t *testing.T) {
+	now := time.Now()
+	p := NewRateProcessor(Collection{
+		Name:      "bytes_per_second",
+		Event:     "bytes",
+		HalfLives: []time.Duration{time.Minute},
+		RateOf:    rateOfValue,
+	})
+	p.now = func() time.Time { return now }
+
+	// Events are flushed in batches of five seconds.
+	for i := 0; i < 120; i++ {
+		var events []event.Event
+		for j := 0; j < 5; j++ {
+			events = append(events, event.Event{
+				Name:      "bytes",
+				Value:     1024,
+				Timestamp: now.Add(time.Duration(j) * time.Second),
+			})
+		}
+		now = now.Add(5 * time.Second)
+		p.Handle(events)
+	}
+	assert.InDelta(t, 1024, p.samples[""].rates[0], 60)
+}
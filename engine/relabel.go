@@ -0,0 +1,231 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/common/model"
+)
+
+const (
+	relabelReplace   = "replace"
+	relabelKeep      = "keep"
+	relabelDrop      = "drop"
+	relabelLabelMap  = "labelmap"
+	relabelLabelDrop = "labeldrop"
+	relabelHashMod   = "hashmod"
+	relabelLowercase = "lowercase"
+)
+
+var defaultRegexp = MustNewRegexp("(.*)")
+
+// relabelTarget matches the target labels of replace actions
+// referring to capture groups of the regex, such as ${1}_total.
+var relabelTarget = regexp.MustCompile(`^(?:(?:[a-zA-Z_]|\$(?:\{\w+\}|\w+))+\w*)+$`)
+
+// DefaultRelabelConfig is the relabeling rule all
+// rules decoded from JSON or YAML start from.
+var DefaultRelabelConfig = RelabelConfig{
+	Separator:   ";",
+	Regex:       defaultRegexp,
+	Replacement: "$1",
+	Action:      relabelReplace,
+}
+
+// RelabelConfig is a rule to rewrite the labels of an event before it
+// is aggregated, similar to Prometheus relabel_configs. The values of
+// SourceLabels are joined by Separator and matched against Regex.
+type RelabelConfig struct {
+	SourceLabels []string `json:"source_labels,omitempty" yaml:"source_labels,omitempty"`
+	Separator    string   `json:"separator,omitempty" yaml:"separator,omitempty"`
+	Regex        Regexp   `json:"regex,omitempty" yaml:"regex,omitempty"`
+	Modulus      uint64   `json:"modulus,omitempty" yaml:"modulus,omitempty"`           // only if action is hashmod
+	TargetLabel  string   `json:"target_label,omitempty" yaml:"target_label,omitempty"` // only if action is replace, hashmod or lowercase
+	Replacement  string   `json:"replacement,omitempty" yaml:"replacement,omitempty"`   // only if action is replace or labelmap
+
+	// Action is replace, keep, drop, labelmap, labeldrop, hashmod
+	// or lowercase. Defaults to replace.
+	Action string `json:"action,omitempty" yaml:"action,omitempty"`
+}
+
+func (c *RelabelConfig) UnmarshalJSON(b []byte) error {
+	type plain RelabelConfig
+	*c = DefaultRelabelConfig
+	return json.Unmarshal(b, (*plain)(c))
+}
+
+func (c *RelabelConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain RelabelConfig
+	*c = DefaultRelabelConfig
+	return unmarshal((*plain)(c))
+}
+
+func (c RelabelConfig) validate() error {
+	switch c.Action {
+	case "", relabelReplace, relabelHashMod, relabelLowercase:
+		if c.TargetLabel == "" {
+			return fmt.Errorf("%q action requires a target label", c.Action)
+		}
+		isTemplate := (c.Action == "" || c.Action == relabelReplace) && strings.Contains(c.TargetLabel, "$")
+		if isTemplate && !relabelTarget.MatchString(c.TargetLabel) || !isTemplate && !model.LabelName(c.TargetLabel).IsValid() {
+			return fmt.Errorf("invalid target label %q", c.TargetLabel)
+		}
+		if c.Action == relabelHashMod && c.Modulus == 0 {
+			return errors.New("hashmod action requires a modulus")
+		}
+	case relabelKeep, relabelDrop, relabelLabelMap, relabelLabelDrop:
+	default:
+		return fmt.Errorf("unknown action %q", c.Action)
+	}
+	return nil
+}
+
+// Regexp is a regular expression anchored at both ends. It is compiled
+// when decoded from JSON or YAML, so invalid expressions are rejected
+// before a collection is enabled.
+type Regexp struct {
+	*regexp.Regexp
+	original string
+}
+
+func NewRegexp(s string) (Regexp, error) {
+	r, err := regexp.Compile("^(?:" + s + ")$")
+	if err != nil {
+		return Regexp{}, err
+	}
+	return Regexp{Regexp: r, original: s}, nil
+}
+
+func MustNewRegexp(s string) Regexp {
+	r, err := NewRegexp(s)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+func (r Regexp) String() string {
+	if r.Regexp == nil {
+		return defaultRegexp.original // the zero Regexp is the default
+	}
+	return r.original
+}
+
+func (r *Regexp) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	var err error
+	*r, err = NewRegexp(s)
+	return err
+}
+
+func (r Regexp) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
+func (r *Regexp) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	var err error
+	*r, err = NewRegexp(s)
+	return err
+}
+
+func (r Regexp) MarshalYAML() (interface{}, error) {
+	return r.String(), nil
+}
+
+// relabel applies the rules to labels and returns the relabeled labels.
+// It returns false if the event should be dropped. labels is not modified.
+func relabel(labels map[string]string, rules []RelabelConfig) (map[string]string, bool) {
+	out := make(map[string]string, len(labels))
+	for k, v := range labels {
+		out[k] = v
+	}
+	for _, rule := range rules {
+		if !relabelOne(out, rule) {
+			return nil, false
+		}
+	}
+	return out, true
+}
+
+func relabelOne(labels map[string]string, rule RelabelConfig) bool {
+	regex := rule.Regex
+	if regex.Regexp == nil {
+		regex = defaultRegexp
+	}
+	values := make([]string, len(rule.SourceLabels))
+	for i, name := range rule.SourceLabels {
+		values[i] = labels[name]
+	}
+	value := strings.Join(values, rule.Separator)
+
+	switch rule.Action {
+	case "", relabelReplace:
+		indexes := regex.FindStringSubmatchIndex(value)
+		if indexes == nil {
+			break
+		}
+		target := string(regex.ExpandString(nil, rule.TargetLabel, value, indexes))
+		if !model.LabelName(target).IsValid() {
+			break
+		}
+		replaced := string(regex.ExpandString(nil, rule.Replacement, value, indexes))
+		if replaced == "" {
+			delete(labels, target)
+			break
+		}
+		labels[target] = replaced
+	case relabelKeep:
+		return regex.MatchString(value)
+	case relabelDrop:
+		return !regex.MatchString(value)
+	case relabelHashMod:
+		sum := md5.Sum([]byte(value))
+		mod := binary.BigEndian.Uint64(sum[8:]) % rule.Modulus
+		labels[rule.TargetLabel] = strconv.FormatUint(mod, 10)
+	case relabelLowercase:
+		labels[rule.TargetLabel] = strings.ToLower(value)
+	case relabelLabelMap:
+		mapped := make(map[string]string)
+		for name, v := range labels {
+			if regex.MatchString(name) {
+				mapped[regex.ReplaceAllString(name, rule.Replacement)] = v
+			}
+		}
+		for name, v := range mapped {
+			labels[name] = v
+		}
+	case relabelLabelDrop:
+		for name := range labels {
+			if regex.MatchString(name) {
+				delete(labels, name)
+			}
+		}
+	}
+	return true
+}
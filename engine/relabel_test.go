@@ -0,0 +1,180 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/rakyll/events2prom/event"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestRelabel(t *testing.T) {
+	labels := map[string]string{
+		"path":        "/users/42/orders",
+		"status":      "201",
+		"Region":      "US-EAST-1",
+		"__meta_node": "node-1",
+	}
+	tests := []struct {
+		name string
+		rule RelabelConfig
+		want map[string]string // nil if dropped
+	}{
+		{
+			name: "replace",
+			rule: RelabelConfig{
+				SourceLabels: []string{"status"},
+				Regex:        MustNewRegexp("(\\d)\\d\\d"),
+				TargetLabel:  "status",
+				Replacement:  "${1}xx",
+			},
+			want: map[string]string{"status": "2xx"},
+		},
+		{
+			name: "replace unmatched",
+			rule: RelabelConfig{
+				SourceLabels: []string{"path"},
+				Regex:        MustNewRegexp("/admin/.*"),
+				TargetLabel:  "path",
+				Replacement:  "/admin",
+			},
+			want: map[string]string{"path": "/users/42/orders"},
+		},
+		{
+			name: "keep",
+			rule: RelabelConfig{
+				SourceLabels: []string{"status"},
+				Regex:        MustNewRegexp("5.."),
+				Action:       relabelKeep,
+			},
+		},
+		{
+			name: "drop",
+			rule: RelabelConfig{
+				SourceLabels: []string{"status"},
+				Regex:        MustNewRegexp("2.."),
+				Action:       relabelDrop,
+			},
+		},
+		{
+			name: "labelmap",
+			rule: RelabelConfig{
+				Regex:       MustNewRegexp("__meta_(.+)"),
+				Replacement: "$1",
+				Action:      relabelLabelMap,
+			},
+			want: map[string]string{"node": "node-1", "__meta_node": "node-1"},
+		},
+		{
+			name: "labeldrop",
+			rule: RelabelConfig{
+				Regex:  MustNewRegexp("__meta_.+"),
+				Action: relabelLabelDrop,
+			},
+			want: map[string]string{"__meta_node": ""},
+		},
+		{
+			name: "hashmod",
+			rule: RelabelConfig{
+				SourceLabels: []string{"path"},
+				Modulus:      4,
+				TargetLabel:  "shard",
+				Action:       relabelHashMod,
+			},
+			want: map[string]string{"shard": "1"},
+		},
+		{
+			name: "lowercase",
+			rule: RelabelConfig{
+				SourceLabels: []string{"Region"},
+				TargetLabel:  "region",
+				Action:       relabelLowercase,
+			},
+			want: map[string]string{"region": "us-east-1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := relabel(labels, []RelabelConfig{tt.rule})
+			if tt.want == nil {
+				assert.False(t, ok)
+				return
+			}
+			assert.True(t, ok)
+			for k, v := range tt.want {
+				assert.Equal(t, got[k], v, k)
+			}
+		})
+	}
+	assert.Equal(t, labels["status"], "201", "labels should not be modified")
+}
+
+func TestRelabel_collection(t *testing.T) {
+	var c Collection
+	assert.NoError(t, yaml.Unmarshal([]byte(`
+name: requests_by_route
+aggregation: count
+event: request
+labels: [route]
+relabel_configs:
+  - source_labels: [path]
+    regex: "/users/[0-9]+(/.*)?"
+    target_label: route
+    replacement: "/users/:id$1"
+`), &c))
+	p := NewCountProcessor(c)
+	p.Handle([]event.Event{
+		{Name: "request", Labels: map[string]string{"path": "/users/1/orders"}},
+		{Name: "request", Labels: map[string]string{"path": "/users/2/orders"}},
+		{Name: "request", Labels: map[string]string{"path": "/health"}},
+	})
+	assert.Equal(t, p.samples["route_/users/:id/orders_"].count, uint64(2))
+	assert.Len(t, p.samples, 1)
+}
+
+func TestRegexp_invalid(t *testing.T) {
+	var c Collection
+	err := json.Unmarshal([]byte(`{"relabel_configs": [{"regex": "(", "target_label": "x"}]}`), &c)
+	assert.Error(t, err)
+
+	err = yaml.Unmarshal([]byte("relabel_configs: [{regex: '(', target_label: x}]"), &c)
+	assert.Error(t, err)
+}
+
+func TestRelabelConfig_validate(t *testing.T) {
+	assert.NoError(t, RelabelConfig{TargetLabel: "route"}.validate())
+	assert.NoError(t, RelabelConfig{TargetLabel: "${1}_route"}.validate())
+	assert.NoError(t, RelabelConfig{Action: relabelLowercase, TargetLabel: "region"}.validate())
+	assert.Error(t, RelabelConfig{TargetLabel: "$"}.validate())
+	assert.Error(t, RelabelConfig{Action: relabelHashMod, Modulus: 2, TargetLabel: "\xff"}.validate())
+	assert.Error(t, RelabelConfig{Action: relabelLowercase, TargetLabel: "\xff"}.validate())
+}
+
+func TestRegexp_default(t *testing.T) {
+	var c RelabelConfig
+	b, err := json.Marshal(c)
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(b, &c))
+	assert.Equal(t, c.Regex.String(), defaultRegexp.String())
+	assert.True(t, c.Regex.MatchString("any value"))
+
+	c = RelabelConfig{}
+	out, err := yaml.Marshal(c)
+	assert.NoError(t, err)
+	assert.NoError(t, yaml.Unmarshal(out, &c))
+	assert.Equal(t, c.Regex.String(), defaultRegexp.String())
+}
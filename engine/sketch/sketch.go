@@ -0,0 +1,155 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sketch implements a mergeable quantile sketch (DDSketch)
+// with relative-error guarantees.
+package sketch
+
+import (
+	"maps"
+	"math"
+	"sort"
+)
+
+// minIndexable is the smallest absolute value that is stored in a
+// log-scaled bucket. Smaller values are counted in the zero bucket.
+const minIndexable = 1e-9
+
+// Sketch approximates quantiles of the values added to it.
+// A quantile returned by the sketch is within RelativeAccuracy
+// of the true value, regardless of the distribution of the input.
+type Sketch struct {
+	relativeAccuracy float64
+	gamma            float64
+	logGamma         float64
+
+	positive map[int]uint64
+	negative map[int]uint64
+	zero     uint64
+	count    uint64
+	sum      float64
+}
+
+// New returns an empty sketch with the given relative accuracy,
+// e.g. 0.01 for quantiles within 1% of the true value.
+func New(relativeAccuracy float64) *Sketch {
+	gamma := (1 + relativeAccuracy) / (1 - relativeAccuracy)
+	return &Sketch{
+		relativeAccuracy: relativeAccuracy,
+		gamma:            gamma,
+		logGamma:         math.Log(gamma),
+		positive:         make(map[int]uint64),
+		negative:         make(map[int]uint64),
+	}
+}
+
+func (s *Sketch) Add(v float64) {
+	switch {
+	case v > minIndexable:
+		s.positive[s.index(v)]++
+	case v < -minIndexable:
+		s.negative[s.index(-v)]++
+	default:
+		s.zero++
+	}
+	s.count++
+	s.sum += v
+}
+
+// Merge adds all values in o to s. Both sketches
+// must have the same relative accuracy.
+func (s *Sketch) Merge(o *Sketch) {
+	for k, c := range o.positive {
+		s.positive[k] += c
+	}
+	for k, c := range o.negative {
+		s.negative[k] += c
+	}
+	s.zero += o.zero
+	s.count += o.count
+	s.sum += o.sum
+}
+
+// Quantile returns the approximate value at quantile q,
+// where q is in [0, 1]. It returns NaN if the sketch is empty.
+func (s *Sketch) Quantile(q float64) float64 {
+	if s.count == 0 || q < 0 || q > 1 {
+		return math.NaN()
+	}
+	rank := uint64(q * float64(s.count-1))
+
+	var seen uint64
+	// Negative values are visited from the largest
+	// absolute value to the smallest.
+	keys := sortedKeys(s.negative)
+	for i := len(keys) - 1; i >= 0; i-- {
+		seen += s.negative[keys[i]]
+		if seen > rank {
+			return -s.value(keys[i])
+		}
+	}
+	seen += s.zero
+	if seen > rank {
+		return 0
+	}
+	keys = sortedKeys(s.positive)
+	for _, k := range keys {
+		seen += s.positive[k]
+		if seen > rank {
+			return s.value(k)
+		}
+	}
+	return s.value(keys[len(keys)-1])
+}
+
+// Clone returns a copy of s.
+func (s *Sketch) Clone() *Sketch {
+	c := *s
+	c.positive = maps.Clone(s.positive)
+	c.negative = maps.Clone(s.negative)
+	return &c
+}
+
+func (s *Sketch) Count() uint64 {
+	return s.count
+}
+
+func (s *Sketch) Sum() float64 {
+	return s.sum
+}
+
+// Reset removes all values from the sketch.
+func (s *Sketch) Reset() {
+	s.positive = make(map[int]uint64)
+	s.negative = make(map[int]uint64)
+	s.zero = 0
+	s.count = 0
+	s.sum = 0
+}
+
+func (s *Sketch) index(v float64) int {
+	return int(math.Ceil(math.Log(v) / s.logGamma))
+}
+
+func (s *Sketch) value(index int) float64 {
+	return 2 * math.Pow(s.gamma, float64(index)) / (1 + s.gamma)
+}
+
+func sortedKeys(m map[int]uint64) []int {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
@@ -0,0 +1,74 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sketch
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmptySketch(t *testing.T) {
+	s := New(0.01)
+	assert.True(t, math.IsNaN(s.Quantile(0.5)))
+	assert.Equal(t, s.Count(), uint64(0))
+}
+
+func TestSketch(t *testing.T) {
+	s := New(0.01)
+	for i := float64(1); i <= 1000; i++ {
+		s.Add(i)
+	}
+	for _, q := range []float64{0, 0.5, 0.9, 0.99, 1} {
+		want := 1 + q*999
+		assert.InEpsilon(t, want, s.Quantile(q), 0.01, "q=%v", q)
+	}
+	assert.Equal(t, s.Count(), uint64(1000))
+	assert.Equal(t, s.Sum(), 500500.0)
+}
+
+func TestSketch_negativeAndZero(t *testing.T) {
+	s := New(0.01)
+	for _, v := range []float64{-100, -10, 0, 10, 100} {
+		s.Add(v)
+	}
+	assert.InEpsilon(t, -100, s.Quantile(0), 0.01)
+	assert.Equal(t, 0.0, s.Quantile(0.5))
+	assert.InEpsilon(t, 100, s.Quantile(1), 0.01)
+}
+
+func TestSketch_merge(t *testing.T) {
+	a, b := New(0.01), New(0.01)
+	for i := float64(1); i <= 500; i++ {
+		a.Add(i)
+		b.Add(i + 500)
+	}
+	a.Merge(b)
+	assert.Equal(t, a.Count(), uint64(1000))
+	assert.InEpsilon(t, 500.5, a.Quantile(0.5), 0.01)
+
+	a.Reset()
+	assert.Equal(t, a.Count(), uint64(0))
+}
+
+func BenchmarkAdd(b *testing.B) {
+	s := New(0.01)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < 1000; j++ {
+			s.Add(float64(j))
+		}
+	}
+}
@@ -0,0 +1,301 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rakyll/events2prom/event"
+)
+
+var _ Processor = &SLOProcessor{}
+
+var defaultBurnRateWindows = []time.Duration{5 * time.Minute, time.Hour, 6 * time.Hour}
+
+// sloWindowBuckets is the number of sub-windows burn
+// rate windows move by.
+const sloWindowBuckets = 10
+
+type sloSample struct {
+	series
+	total uint64
+	good  []uint64 // by threshold
+
+	windows []sloWindow // by burn rate window
+}
+
+// sloWindow counts events and bad events over a burn rate window in
+// a ring of sub-windows, indexed by the number of sub-window intervals
+// since the Unix epoch, so sub-windows older than the window are
+// skipped by Collect and reused by later events.
+type sloWindow struct {
+	epochs []int64  // by sub-window
+	total  []uint64 // by sub-window
+	bad    []uint64 // by sub-window and threshold
+}
+
+func (s sloSample) clone() sloSample {
+	s.good = slices.Clone(s.good)
+	s.windows = slices.Clone(s.windows)
+	for i, w := range s.windows {
+		s.windows[i] = sloWindow{
+			epochs: slices.Clone(w.epochs),
+			total:  slices.Clone(w.total),
+			bad:    slices.Clone(w.bad),
+		}
+	}
+	return s
+}
+
+// SLOProcessor counts the events that are good for a service level
+// objective, those with a value at or under a threshold and not
+// selected by Errors, and all events. It exports the counts as
+// <name>_good_total, by threshold in the le label, and <name>_total.
+//
+// It also exports the rate the error budget is spent at as
+// <name>_burn_rate, by threshold and window: the ratio of bad
+// events in the window divided by the ratio allowed by the
+// objective. Windows move a tenth of their size at a time, and
+// burn rates are zero when there are no events in the window.
+type SLOProcessor struct {
+	col        Collection
+	thresholds []string
+	intervals  []time.Duration // of the sub-windows of each window
+	windows    []string
+
+	samples map[string]sloSample // published, see doubleBuffer
+	buffer  doubleBuffer[sloSample]
+	now     func() time.Time
+
+	goodDesc     *prometheus.Desc
+	totalDesc    *prometheus.Desc
+	burnRateDesc *prometheus.Desc
+}
+
+func validateSLO(c Collection) error {
+	if len(c.Thresholds) == 0 {
+		return errors.New("no thresholds")
+	}
+	for _, t := range c.Thresholds {
+		if math.IsNaN(t) {
+			return errors.New("invalid threshold NaN")
+		}
+	}
+	if c.Objective <= 0 || c.Objective >= 1 {
+		return fmt.Errorf("objective %v should be between 0 and 1", c.Objective)
+	}
+	for _, w := range c.BurnRateWindows {
+		if w <= 0 {
+			return fmt.Errorf("invalid burn rate window %v", w)
+		}
+	}
+	if err := c.Errors.validate(); err != nil {
+		return fmt.Errorf("invalid errors: %v", err)
+	}
+	return nil
+}
+
+func NewSLOProcessor(c Collection) *SLOProcessor {
+	if len(c.BurnRateWindows) == 0 {
+		c.BurnRateWindows = defaultBurnRateWindows
+	}
+	thresholds := make([]string, len(c.Thresholds))
+	for i, t := range c.Thresholds {
+		thresholds[i] = strconv.FormatFloat(t, 'f', -1, 64)
+	}
+	intervals := make([]time.Duration, len(c.BurnRateWindows))
+	windows := make([]string, len(c.BurnRateWindows))
+	for i, w := range c.BurnRateWindows {
+		intervals[i] = max(w/sloWindowBuckets, 1)
+		windows[i] = w.String()
+	}
+	name := c.metricName()
+	byThreshold := append(append([]string{}, c.Labels...), "le")
+	return &SLOProcessor{
+		col:          c,
+		thresholds:   thresholds,
+		intervals:    intervals,
+		windows:      windows,
+		samples:      make(map[string]sloSample),
+		now:          time.Now,
+		goodDesc:     prometheus.NewDesc(name+"_good_total", c.Description, byThreshold, c.ConstLabels),
+		totalDesc:    prometheus.NewDesc(name+"_total", c.Description, c.Labels, c.ConstLabels),
+		burnRateDesc: prometheus.NewDesc(name+"_burn_rate", c.Description, append(byThreshold, "window"), c.ConstLabels),
+	}
+}
+
+func (p *SLOProcessor) Collection() Collection {
+	return p.col
+}
+
+func (p *SLOProcessor) Handle(events []event.Event) {
+	now := p.now()
+	if len(events) == 0 && !hasStale(p.samples, p.col.TTL, now) {
+		return // nothing to aggregate or expire
+	}
+	samples := p.buffer.begin()
+	p.buffer.expire(p.col.TTL, now)
+	for _, e := range events {
+		if e, ok := p.col.Match(e); ok {
+			key, labelVals, s, ok := lookupSample(samples, p.col, e)
+			if !ok {
+				s = p.newSample(labelVals)
+			} else if !p.buffer.isSet(key) {
+				// Published counts are read by Collect.
+				s = s.clone()
+			}
+			ts := e.Timestamp
+			if ts.IsZero() || ts.After(now) {
+				ts = now
+			}
+			p.observe(&s, ts, e)
+			s.updated = now
+			p.buffer.set(key, s)
+		}
+	}
+	p.col.reportSeries(len(samples))
+	p.samples = p.buffer.publish()
+}
+
+func (p *SLOProcessor) newSample(labelVals []string) sloSample {
+	s := sloSample{
+		series:  series{labelValues: labelVals},
+		good:    make([]uint64, len(p.col.Thresholds)),
+		windows: make([]sloWindow, len(p.intervals)),
+	}
+	for i := range s.windows {
+		s.windows[i] = sloWindow{
+			epochs: make([]int64, sloWindowBuckets),
+			total:  make([]uint64, sloWindowBuckets),
+			bad:    make([]uint64, sloWindowBuckets*len(p.col.Thresholds)),
+		}
+	}
+	return s
+}
+
+// observe counts e in s at time ts. Events older than the
+// sub-windows they would be counted in are only counted in
+// the totals.
+func (p *SLOProcessor) observe(s *sloSample, ts time.Time, e event.Event) {
+	isError := p.col.Errors != nil && p.col.Errors.matches(e)
+	s.total++
+	for j, t := range p.col.Thresholds {
+		if !isError && e.Value <= t {
+			s.good[j]++
+		}
+	}
+	for i, interval := range p.intervals {
+		w := s.windows[i]
+		epoch := ts.UnixNano() / int64(interval)
+		b := int(epoch % sloWindowBuckets)
+		switch {
+		case w.epochs[b] > epoch:
+			continue // the sub-window was reused by later events
+		case w.epochs[b] < epoch:
+			w.epochs[b] = epoch
+			w.total[b] = 0
+			clear(w.bad[b*len(p.col.Thresholds) : (b+1)*len(p.col.Thresholds)])
+		}
+		w.total[b]++
+		for j, t := range p.col.Thresholds {
+			if isError || e.Value > t {
+				w.bad[b*len(p.col.Thresholds)+j]++
+			}
+		}
+	}
+}
+
+func (p *SLOProcessor) CopySamples(old Processor) error {
+	o, err := updatedProcessor[*SLOProcessor](p, old)
+	if err != nil {
+		return err
+	}
+	if !slices.Equal(p.col.Thresholds, o.col.Thresholds) || !slices.Equal(p.col.BurnRateWindows, o.col.BurnRateWindows) {
+		return errors.New("thresholds or burn rate windows changed")
+	}
+	p.samples = maps.Clone(o.samples)
+	p.buffer.replace(p.samples)
+	return nil
+}
+
+func (p *SLOProcessor) ResetSamples(matchers []LabelMatcher) {
+	p.samples = withoutMatching(p.samples, p.col.Labels, matchers)
+	p.col.reportSeries(len(p.samples))
+	p.buffer.replace(p.samples)
+}
+
+func (p *SLOProcessor) Describe(ch chan<- *prometheus.Desc) {
+	ch <- p.goodDesc
+	ch <- p.totalDesc
+	ch <- p.burnRateDesc
+}
+
+func (p *SLOProcessor) Collect(ch chan<- prometheus.Metric) {
+	samples, release := p.buffer.load()
+	defer release()
+	now := p.now()
+	budget := 1 - p.col.Objective
+	for _, sample := range samples {
+		if sample.isStale(p.col.TTL, now) {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(
+			p.totalDesc,
+			prometheus.CounterValue,
+			float64(sample.total),
+			sample.labelValues...,
+		)
+		for j, threshold := range p.thresholds {
+			labelVals := append(slices.Clip(sample.labelValues), threshold)
+			ch <- prometheus.MustNewConstMetric(
+				p.goodDesc,
+				prometheus.CounterValue,
+				float64(sample.good[j]),
+				labelVals...,
+			)
+			for i, window := range p.windows {
+				var burnRate float64
+				if total, bad := p.windowCounts(sample.windows[i], p.intervals[i], j, now); total > 0 {
+					burnRate = float64(bad) / float64(total) / budget
+				}
+				ch <- prometheus.MustNewConstMetric(
+					p.burnRateDesc,
+					prometheus.GaugeValue,
+					burnRate,
+					append(slices.Clip(labelVals), window)...,
+				)
+			}
+		}
+	}
+}
+
+// windowCounts returns the events and the bad events for the
+// threshold j in the sub-windows of w that are in the window at now.
+func (p *SLOProcessor) windowCounts(w sloWindow, interval time.Duration, j int, now time.Time) (total, bad uint64) {
+	epoch := now.UnixNano() / int64(interval)
+	for b, e := range w.epochs {
+		if e > epoch-sloWindowBuckets && e <= epoch {
+			total += w.total[b]
+			bad += w.bad[b*len(p.thresholds)+j]
+		}
+	}
+	return total, bad
+}
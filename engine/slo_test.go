@@ -0,0 +1,121 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rakyll/events2prom/event"
+	"github.com/stretchr/testify/assert"
+)
+
+func collectSLO(t *testing.T, p *SLOProcessor) map[string]float64 {
+	ch := make(chan prometheus.Metric, 64)
+	p.Collect(ch)
+	close(ch)
+
+	names := map[*prometheus.Desc]string{
+		p.goodDesc:     p.col.Name + "_good_total",
+		p.totalDesc:    p.col.Name + "_total",
+		p.burnRateDesc: p.col.Name + "_burn_rate",
+	}
+	values := make(map[string]float64)
+	for m := range ch {
+		var pb dto.Metric
+		assert.NoError(t, m.Write(&pb))
+		key := names[m.Desc()]
+		for _, l := range pb.GetLabel() {
+			key += " " + l.GetValue()
+		}
+		values[key] = pb.GetCounter().GetValue() + pb.GetGauge().GetValue()
+	}
+	return values
+}
+
+func TestSLO(t *testing.T) {
+	now := time.Unix(6e8, 0) // at the start of a sub-window
+	regex := MustNewRegexp("5..")
+	p := NewSLOProcessor(Collection{
+		Name:            "request_latency_ms",
+		Event:           "request_latency_ms",
+		Labels:          []string{"region"},
+		Thresholds:      []float64{300, 1000},
+		Objective:       0.99,
+		Errors:          &Filter{Labels: []LabelMatcher{{Name: "status", Op: "=~", Value: "5..", regex: regex}}},
+		BurnRateWindows: []time.Duration{time.Minute},
+	})
+	p.now = func() time.Time { return now }
+
+	request := func(latency float64, status string) event.Event {
+		return event.Event{
+			Name:   "request_latency_ms",
+			Labels: map[string]string{"region": "us-east-1", "status": status},
+			Value:  latency,
+		}
+	}
+	p.Handle([]event.Event{
+		request(100, "200"),
+		request(500, "200"),
+		request(2000, "200"),
+		request(100, "503"),
+	})
+
+	values := collectSLO(t, p)
+	assert.Equal(t, values["request_latency_ms_total us-east-1"], 4.0)
+	assert.Equal(t, values["request_latency_ms_good_total 300 us-east-1"], 1.0)
+	assert.Equal(t, values["request_latency_ms_good_total 1000 us-east-1"], 2.0)
+	assert.InDelta(t, values["request_latency_ms_burn_rate 300 us-east-1 1m0s"], 75, 1e-9)
+	assert.InDelta(t, values["request_latency_ms_burn_rate 1000 us-east-1 1m0s"], 50, 1e-9)
+
+	// The window moves by sub-windows of six seconds.
+	now = now.Add(30 * time.Second)
+	p.Handle([]event.Event{request(100, "200"), request(100, "200")})
+
+	values = collectSLO(t, p)
+	assert.Equal(t, values["request_latency_ms_total us-east-1"], 6.0)
+	assert.Equal(t, values["request_latency_ms_good_total 1000 us-east-1"], 4.0)
+	assert.InDelta(t, values["request_latency_ms_burn_rate 1000 us-east-1 1m0s"], 2.0/6/0.01, 1e-9)
+
+	// The first events are out of the window, and
+	// events older than the window are only counted.
+	now = now.Add(50 * time.Second)
+	old := request(2000, "200")
+	old.Timestamp = now.Add(-2 * time.Minute)
+	p.Handle([]event.Event{old})
+
+	values = collectSLO(t, p)
+	assert.Equal(t, values["request_latency_ms_total us-east-1"], 7.0)
+	assert.Equal(t, values["request_latency_ms_good_total 1000 us-east-1"], 4.0)
+	assert.Equal(t, values["request_latency_ms_burn_rate 1000 us-east-1 1m0s"], 0.0)
+
+	// Burn rates drop to zero without events.
+	p.Handle([]event.Event{request(2000, "200")})
+	assert.InDelta(t, collectSLO(t, p)["request_latency_ms_burn_rate 1000 us-east-1 1m0s"], 1.0/3/0.01, 1e-9)
+	now = now.Add(time.Hour)
+	values = collectSLO(t, p)
+	assert.Equal(t, values["request_latency_ms_total us-east-1"], 8.0)
+	assert.Equal(t, values["request_latency_ms_burn_rate 1000 us-east-1 1m0s"], 0.0)
+}
+
+func TestValidateSLO(t *testing.T) {
+	assert.NoError(t, validateSLO(Collection{Thresholds: []float64{300}, Objective: 0.99}))
+	assert.Error(t, validateSLO(Collection{Objective: 0.99}))
+	assert.Error(t, validateSLO(Collection{Thresholds: []float64{300}}))
+	assert.Error(t, validateSLO(Collection{Thresholds: []float64{300}, Objective: 99}))
+	assert.Error(t, validateSLO(Collection{Thresholds: []float64{300}, Objective: 0.99, BurnRateWindows: []time.Duration{0}}))
+	assert.Error(t, validateSLO(Collection{Thresholds: []float64{300}, Objective: 0.99, Errors: &Filter{Labels: []LabelMatcher{{Name: "status", Op: "=~", Value: "5.."}}}}))
+}
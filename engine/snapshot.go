@@ -0,0 +1,341 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"maps"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// snapshot holds the samples of a processor published for Collect.
+//
+// Processors never modify published samples. Handle aggregates a
+// batch of events into a copy of the published samples and then
+// publishes the copy, so scrapes don't wait for aggregation and
+// aggregation doesn't wait for scrapes. Handle should not be called
+// concurrently with itself.
+type snapshot[S any] struct {
+	samples atomic.Pointer[map[string]S]
+}
+
+// load returns the published samples, which must not be modified.
+func (s *snapshot[S]) load() map[string]S {
+	if samples := s.samples.Load(); samples != nil {
+		return *samples
+	}
+	return nil
+}
+
+// publish publishes samples, which must not
+// be modified by the caller afterwards.
+func (s *snapshot[S]) publish(samples map[string]S) {
+	s.samples.Store(&samples)
+}
+
+// take unpublishes the published samples and returns them,
+// or nil if they were already taken. The caller of take
+// owns the samples and may modify them.
+func (s *snapshot[S]) take() map[string]S {
+	if samples := s.samples.Swap(nil); samples != nil {
+		return *samples
+	}
+	return nil
+}
+
+// doubleBuffer holds the samples of a processor in two maps, one
+// published for Collect and one Handle aggregates a batch of events
+// into, swapped after each batch. Rather than copying all samples,
+// Handle replays the samples changed by the last batch into the map
+// it aggregates into, so a batch costs as much as the series it
+// changes. If the map is still being collected, it's copied instead.
+// Samples must not be modified once set, as they are shared by the
+// maps, e.g. slices should be copied first.
+type doubleBuffer[S interface {
+	isStale(time.Duration, time.Time) bool
+}] struct {
+	front atomic.Pointer[sampleBuffer[S]]
+
+	back    *sampleBuffer[S] // locked between begin and publish, access only in Handle
+	changed map[string]bool  // keys set or deleted since the last swap, access only in Handle
+}
+
+type sampleBuffer[S any] struct {
+	mu      sync.RWMutex // read locked by Collect, locked by Handle
+	samples map[string]S
+}
+
+// begin returns the samples for Handle to aggregate a
+// batch of events into, as of the published samples.
+func (b *doubleBuffer[S]) begin() map[string]S {
+	front := b.front.Load()
+	if front == nil {
+		front = &sampleBuffer[S]{samples: make(map[string]S)}
+		b.front.Store(front)
+	}
+	if b.back != nil && b.back.mu.TryLock() {
+		for key := range b.changed {
+			if s, ok := front.samples[key]; ok {
+				b.back.samples[key] = s
+			} else {
+				delete(b.back.samples, key)
+			}
+		}
+	} else {
+		// The first batch, or the samples are being collected.
+		b.back = &sampleBuffer[S]{samples: maps.Clone(front.samples)}
+		b.back.mu.Lock()
+	}
+	if b.changed == nil {
+		b.changed = make(map[string]bool)
+	}
+	clear(b.changed)
+	return b.back.samples
+}
+
+// set sets the sample with the given key in the samples returned by begin.
+func (b *doubleBuffer[S]) set(key string, s S) {
+	b.back.samples[key] = s
+	b.changed[key] = true
+}
+
+// isSet reports whether the sample with the given key was set since
+// begin, so it isn't shared with the published samples anymore.
+func (b *doubleBuffer[S]) isSet(key string) bool {
+	return b.changed[key]
+}
+
+// expire removes the samples returned by begin that
+// have no events for longer than ttl.
+func (b *doubleBuffer[S]) expire(ttl time.Duration, now time.Time) {
+	if ttl <= 0 {
+		return
+	}
+	for key, s := range b.back.samples {
+		if s.isStale(ttl, now) {
+			delete(b.back.samples, key)
+			b.changed[key] = true
+		}
+	}
+}
+
+// publish publishes the samples returned by begin and returns them.
+// They must not be modified until returned by begin again.
+func (b *doubleBuffer[S]) publish() map[string]S {
+	back := b.back
+	b.back = b.front.Swap(back)
+	back.mu.Unlock()
+	return back.samples
+}
+
+// replace publishes samples in place of all samples, e.g. when they
+// are copied or reset outside of Handle. It should not be called
+// concurrently with Handle.
+func (b *doubleBuffer[S]) replace(samples map[string]S) {
+	b.front.Store(&sampleBuffer[S]{samples: samples})
+	b.back = nil
+}
+
+// load returns the published samples, which must not be
+// modified, and a function to call once done with them.
+func (b *doubleBuffer[S]) load() (map[string]S, func()) {
+	front := b.front.Load()
+	if front == nil {
+		return nil, func() {}
+	}
+	// If Handle aggregated into front since, it has
+	// published it again once the lock is acquired.
+	front.mu.RLock()
+	return front.samples, front.mu.RUnlock
+}
+
+// resetBuffer holds the samples of a processor that can be reset on
+// flush or scrape. Samples that are never reset are double buffered,
+// see doubleBuffer. Samples reset on flush start empty every batch and
+// samples reset on scrape are handed back and forth with Collect, see
+// nextSamples, so they aren't copied and are published as a snapshot.
+type resetBuffer[S interface {
+	isStale(time.Duration, time.Time) bool
+}] struct {
+	reset    string
+	buffer   doubleBuffer[S] // if not reset
+	snapshot snapshot[S]     // if reset
+	samples  map[string]S    // returned by begin if reset, access only in Handle
+}
+
+// begin returns the samples for Handle to aggregate a batch
+// of events into, given the samples of the last batch.
+func (b *resetBuffer[S]) begin(samples map[string]S) map[string]S {
+	if b.reset == "" {
+		return b.buffer.begin()
+	}
+	b.samples = nextSamples(samples, &b.snapshot, b.reset)
+	return b.samples
+}
+
+// set sets the sample with the given key in the samples returned by begin.
+func (b *resetBuffer[S]) set(key string, s S) {
+	if b.reset == "" {
+		b.buffer.set(key, s)
+		return
+	}
+	b.samples[key] = s
+}
+
+// expire removes the samples returned by begin that
+// have no events for longer than ttl.
+func (b *resetBuffer[S]) expire(ttl time.Duration, now time.Time) {
+	if b.reset == "" {
+		b.buffer.expire(ttl, now)
+		return
+	}
+	expire(b.samples, ttl, now)
+}
+
+// publish publishes the samples returned by begin and returns them.
+func (b *resetBuffer[S]) publish() map[string]S {
+	if b.reset == "" {
+		return b.buffer.publish()
+	}
+	b.snapshot.publish(b.samples)
+	return b.samples
+}
+
+// take returns samples, the samples last published, for them to be
+// copied or reset outside of Handle. Samples reset on scrape are taken
+// from Collect, and are nil if Collect took them first.
+func (b *resetBuffer[S]) take(samples map[string]S) map[string]S {
+	if b.reset == resetOnScrape {
+		return b.snapshot.take()
+	}
+	return samples
+}
+
+// replace publishes samples in place of all samples, e.g. when they
+// are copied or reset outside of Handle. It should not be called
+// concurrently with Handle.
+func (b *resetBuffer[S]) replace(samples map[string]S) {
+	if b.reset == "" {
+		b.buffer.replace(samples)
+		return
+	}
+	b.snapshot.publish(samples)
+}
+
+// load returns the samples for Collect to export, which must not be
+// modified, and a function to call once done with them. Samples reset
+// on scrape are taken, so the next batch starts over from no samples,
+// and reports the series it leaves to the limiter.
+func (b *resetBuffer[S]) load() (map[string]S, func()) {
+	switch b.reset {
+	case "":
+		return b.buffer.load()
+	case resetOnScrape:
+		return b.snapshot.take(), func() {}
+	}
+	return b.snapshot.load(), func() {}
+}
+
+// skip reports whether Handle can skip a batch of no events, as it
+// wouldn't change samples, the samples of the last batch.
+func (b *resetBuffer[S]) skip(samples map[string]S, ttl time.Duration, now time.Time) bool {
+	switch b.reset {
+	case "":
+		return !hasStale(samples, ttl, now)
+	case resetOnFlush:
+		return len(samples) == 0
+	}
+	// Samples are reset by the next scrape anyway,
+	// unless Collect took them since the last batch.
+	return b.snapshot.load() != nil
+}
+
+// nextSamples returns the samples for Handle to aggregate a batch of
+// events into, given the samples of the last batch and whether they
+// are reset on flush or scrape. Samples reset on flush start empty.
+// Samples reset on scrape are handed back and forth between Handle and
+// Collect without copying, and start empty once taken by Collect. While
+// Handle aggregates them, Collect sees no samples.
+func nextSamples[S any](samples map[string]S, s *snapshot[S], reset string) map[string]S {
+	if reset == resetOnFlush {
+		return make(map[string]S, len(samples))
+	}
+	if s.take() == nil {
+		// samples may be being collected.
+		return make(map[string]S)
+	}
+	return samples
+}
+
+// pendingRotations returns the number of rotations due at now in a
+// ring of n buckets, where the next rotation is at next. It's n if
+// all buckets are older than maxAge.
+func pendingRotations(now, next time.Time, interval, maxAge time.Duration, n int) int {
+	if interval <= 0 || now.Before(next) {
+		return 0
+	}
+	if now.Sub(next) >= maxAge {
+		return n
+	}
+	k := int(now.Sub(next)/interval) + 1
+	if k > n {
+		k = n
+	}
+	return k
+}
+
+// isRotated reports whether the bucket i of a ring of n buckets
+// whose head is at head is reset by the next k rotations.
+func isRotated(i, head, k, n int) bool {
+	return (i-head-1+n)%n < k
+}
+
+// processorsCollector collects the processors of all collections.
+//
+// It's an unchecked collector, as the registry doesn't allow a metric
+// to change its help or labels once registered, even if unregistered
+// later, and collections can be updated. The processors are published
+// by Run whenever collections change.
+type processorsCollector struct {
+	processors atomic.Pointer[[]Processor]
+}
+
+func (c *processorsCollector) publish(processors map[string]Processor) {
+	ps := make([]Processor, 0, len(processors))
+	for _, p := range processors {
+		ps = append(ps, p)
+	}
+	c.processors.Store(&ps)
+}
+
+func (c *processorsCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (c *processorsCollector) Collect(ch chan<- prometheus.Metric) {
+	ps := c.processors.Load()
+	if ps == nil {
+		return
+	}
+	var wg sync.WaitGroup
+	wg.Add(len(*ps))
+	for _, p := range *ps {
+		go func(p Processor) {
+			defer wg.Done()
+			p.Collect(ch)
+		}(p)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,65 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDoubleBuffer(t *testing.T) {
+	var b doubleBuffer[sumSample]
+	now := time.Now()
+
+	b.begin()
+	b.set("a", sumSample{series: series{updated: now}, sum: 1})
+	b.set("b", sumSample{series: series{updated: now}, sum: 2})
+	assert.Equal(t, b.publish(), map[string]sumSample{
+		"a": {series: series{updated: now}, sum: 1},
+		"b": {series: series{updated: now}, sum: 2},
+	})
+
+	// The changes of the last batch are replayed.
+	samples := b.begin()
+	assert.Len(t, samples, 2)
+	assert.False(t, b.isSet("a"))
+	b.set("a", sumSample{series: series{updated: now}, sum: 3})
+	assert.True(t, b.isSet("a"))
+	published, release := b.load()
+	assert.Equal(t, published["a"].sum, 1.0)
+	release()
+	b.publish()
+
+	// b is stale, while the samples of the last batch are collected.
+	collected, release := b.load()
+	later := now.Add(2 * time.Minute)
+	b.begin()
+	b.set("a", sumSample{series: series{updated: later}, sum: 4})
+	b.expire(time.Minute, later)
+	assert.Equal(t, b.publish(), map[string]sumSample{
+		"a": {series: series{updated: later}, sum: 4},
+	})
+
+	// The samples to aggregate into are still being collected,
+	// so the published samples are copied rather than waited for.
+	assert.Equal(t, b.begin(), map[string]sumSample{
+		"a": {series: series{updated: later}, sum: 4},
+	})
+	assert.Len(t, collected, 2)
+	assert.Equal(t, collected["a"].sum, 3.0)
+	release()
+	b.publish()
+}
@@ -14,7 +14,8 @@
 package engine
 
 import (
-	"sync"
+	"maps"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rakyll/events2prom/event"
@@ -23,15 +24,15 @@ import (
 var _ Processor = &SumProcessor{}
 
 type sumSample struct {
-	labelValues []string
-	sum         float64
+	series
+	sum float64
 }
 
 type SumProcessor struct {
 	col Collection
 
-	samplesMu sync.RWMutex
-	samples   map[string]sumSample
+	samples map[string]sumSample // published, see doubleBuffer
+	buffer  doubleBuffer[sumSample]
 
 	prometheusDesc *prometheus.Desc
 }
@@ -39,8 +40,8 @@ type SumProcessor struct {
 func NewSumProcessor(c Collection) *SumProcessor {
 	return &SumProcessor{
 		col:            c,
-		samples:        make(map[string]sumSample, 64),
-		prometheusDesc: prometheus.NewDesc(c.Name, c.Description, c.Labels, nil),
+		samples:        make(map[string]sumSample),
+		prometheusDesc: prometheus.NewDesc(c.metricName(), c.Description, c.Labels, c.ConstLabels),
 	}
 }
 
@@ -49,24 +50,45 @@ func (p *SumProcessor) Collection() Collection {
 }
 
 func (p *SumProcessor) Handle(events []event.Event) {
-	p.samplesMu.Lock()
-	defer p.samplesMu.Unlock()
-
-	col := p.col
+	now := time.Now()
+	if len(events) == 0 && !hasStale(p.samples, p.col.TTL, now) {
+		return // nothing to aggregate or expire
+	}
+	samples := p.buffer.begin()
+	p.buffer.expire(p.col.TTL, now)
 	for _, e := range events {
-		if isMatch(e, col.Event, col.Labels) {
-			key, labelVals := generateKeyLabelVals(p.col, e)
-			_, ok := p.samples[key]
+		if e, ok := p.col.Match(e); ok {
+			key, labelVals, s, ok := lookupSample(samples, p.col, e)
 			if !ok {
-				p.samples[key] = sumSample{
-					labelValues: labelVals,
-				}
+				s = sumSample{series: series{labelValues: labelVals}}
 			}
-			s := p.samples[key]
 			s.sum += e.Value
-			p.samples[key] = s
+			s.updated = now
+			p.buffer.set(key, s)
 		}
 	}
+	p.col.reportSeries(len(samples))
+	p.samples = p.buffer.publish()
+}
+
+func (p *SumProcessor) CopySamples(old Processor) error {
+	o, err := updatedProcessor[*SumProcessor](p, old)
+	if err != nil {
+		return err
+	}
+	p.samples = maps.Clone(o.samples)
+	p.buffer.replace(p.samples)
+	return nil
+}
+
+func (p *SumProcessor) ResetSamples(matchers []LabelMatcher) {
+	p.samples = withoutMatching(p.samples, p.col.Labels, matchers)
+	p.col.reportSeries(len(p.samples))
+	p.buffer.replace(p.samples)
+}
+
+func (p *SumProcessor) seriesKeys() []string {
+	return sampleKeys(p.samples)
 }
 
 func (p *SumProcessor) Describe(ch chan<- *prometheus.Desc) {
@@ -74,10 +96,13 @@ func (p *SumProcessor) Describe(ch chan<- *prometheus.Desc) {
 }
 
 func (p *SumProcessor) Collect(ch chan<- prometheus.Metric) {
-	p.samplesMu.RLock()
-	defer p.samplesMu.RUnlock()
-
-	for _, sample := range p.samples {
+	samples, release := p.buffer.load()
+	defer release()
+	now := time.Now()
+	for _, sample := range samples {
+		if sample.isStale(p.col.TTL, now) {
+			continue
+		}
 		ch <- prometheus.MustNewConstMetric(
 			p.prometheusDesc,
 			// sum is not a first class data type in Promehteus,
@@ -0,0 +1,224 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rakyll/events2prom/engine/sketch"
+	"github.com/rakyll/events2prom/event"
+)
+
+var _ Processor = &SummaryProcessor{}
+
+var (
+	defaultQuantiles        = []float64{0.5, 0.9, 0.99}
+	defaultRelativeAccuracy = 0.01
+	defaultAgeBuckets       = 5
+)
+
+type summarySample struct {
+	series
+	count uint64
+	sum   float64
+
+	// sketches is a ring of sketches, each covering
+	// MaxAge/AgeBuckets of time. sketches[head] is
+	// the one currently receiving values, until
+	// nextRotation.
+	sketches     []*sketch.Sketch
+	head         int
+	nextRotation time.Time
+}
+
+func (s summarySample) clone() summarySample {
+	sketches := make([]*sketch.Sketch, len(s.sketches))
+	for i, sk := range s.sketches {
+		sketches[i] = sk.Clone()
+	}
+	s.sketches = sketches
+	return s
+}
+
+// rotate resets the oldest sketch for each rotation interval
+// passed at now, or all sketches if they're older than maxAge.
+func (s *summarySample) rotate(now time.Time, interval, maxAge time.Duration) {
+	if interval <= 0 || now.Before(s.nextRotation) {
+		return
+	}
+	if now.Sub(s.nextRotation) >= maxAge {
+		for _, sk := range s.sketches {
+			sk.Reset()
+		}
+		s.nextRotation = now.Add(interval)
+		return
+	}
+	for !now.Before(s.nextRotation) {
+		s.head = (s.head + 1) % len(s.sketches)
+		s.sketches[s.head].Reset()
+		s.nextRotation = s.nextRotation.Add(interval)
+	}
+}
+
+// SummaryProcessor exports quantiles of the values of events. Like
+// Prometheus summaries, the sketches of each series rotate on their
+// own, when the series receives values, so they're double buffered
+// like other samples. Collect skips the sketches that are due to rotate.
+type SummaryProcessor struct {
+	col Collection
+	now func() time.Time
+
+	samples map[string]summarySample // published, see doubleBuffer
+	buffer  doubleBuffer[summarySample]
+
+	prometheusDesc *prometheus.Desc
+}
+
+func validateSummary(c Collection) error {
+	for _, q := range c.Quantiles {
+		if math.IsNaN(q) || q < 0 || q > 1 {
+			return fmt.Errorf("invalid quantile %v", q)
+		}
+	}
+	if math.IsNaN(c.RelativeAccuracy) || c.RelativeAccuracy < 0 || c.RelativeAccuracy >= 1 {
+		return fmt.Errorf("invalid relative accuracy %v", c.RelativeAccuracy)
+	}
+	return nil
+}
+
+func NewSummaryProcessor(c Collection) *SummaryProcessor {
+	if len(c.Quantiles) == 0 {
+		c.Quantiles = defaultQuantiles
+	}
+	if c.RelativeAccuracy == 0 {
+		c.RelativeAccuracy = defaultRelativeAccuracy
+	}
+	if c.MaxAge > 0 && c.AgeBuckets <= 0 {
+		c.AgeBuckets = defaultAgeBuckets
+	}
+	if c.MaxAge <= 0 {
+		c.AgeBuckets = 1
+	}
+	return &SummaryProcessor{
+		col:            c,
+		now:            time.Now,
+		samples:        make(map[string]summarySample),
+		prometheusDesc: prometheus.NewDesc(c.metricName(), c.Description, c.Labels, c.ConstLabels),
+	}
+}
+
+func (p *SummaryProcessor) Collection() Collection {
+	return p.col
+}
+
+func (p *SummaryProcessor) Handle(events []event.Event) {
+	now := p.now()
+	if len(events) == 0 && !hasStale(p.samples, p.col.TTL, now) {
+		return // nothing to aggregate or expire
+	}
+	samples := p.buffer.begin()
+	p.buffer.expire(p.col.TTL, now)
+	interval := p.rotationInterval()
+	for _, e := range events {
+		if e, ok := p.col.Match(e); ok {
+			key, labelVals, s, ok := lookupSample(samples, p.col, e)
+			if !ok {
+				s = summarySample{
+					series:       series{labelValues: labelVals},
+					sketches:     make([]*sketch.Sketch, p.col.AgeBuckets),
+					nextRotation: now.Add(interval),
+				}
+				for i := range s.sketches {
+					s.sketches[i] = sketch.New(p.col.RelativeAccuracy)
+				}
+			} else if !p.buffer.isSet(key) {
+				// Published sketches are read by Collect.
+				s = s.clone()
+			}
+			s.rotate(now, interval, p.col.MaxAge)
+			s.sketches[s.head].Add(e.Value)
+			s.count++
+			s.sum += e.Value
+			s.updated = now
+			p.buffer.set(key, s)
+		}
+	}
+	p.col.reportSeries(len(samples))
+	p.samples = p.buffer.publish()
+}
+
+func (p *SummaryProcessor) CopySamples(old Processor) error {
+	o, err := updatedProcessor[*SummaryProcessor](p, old)
+	if err != nil {
+		return err
+	}
+	if p.col.RelativeAccuracy != o.col.RelativeAccuracy || p.col.MaxAge != o.col.MaxAge || p.col.AgeBuckets != o.col.AgeBuckets {
+		return errors.New("sketch options changed")
+	}
+	p.samples = maps.Clone(o.samples)
+	p.buffer.replace(p.samples)
+	return nil
+}
+
+func (p *SummaryProcessor) ResetSamples(matchers []LabelMatcher) {
+	p.samples = withoutMatching(p.samples, p.col.Labels, matchers)
+	p.col.reportSeries(len(p.samples))
+	p.buffer.replace(p.samples)
+}
+
+func (p *SummaryProcessor) Describe(ch chan<- *prometheus.Desc) {
+	ch <- p.prometheusDesc
+}
+
+func (p *SummaryProcessor) Collect(ch chan<- prometheus.Metric) {
+	samples, release := p.buffer.load()
+	defer release()
+	now := p.now()
+	interval := p.rotationInterval()
+	for _, sample := range samples {
+		if sample.isStale(p.col.TTL, now) {
+			continue
+		}
+		rotations := pendingRotations(now, sample.nextRotation, interval, p.col.MaxAge, len(sample.sketches))
+		merged := sketch.New(p.col.RelativeAccuracy)
+		for i, s := range sample.sketches {
+			if !isRotated(i, sample.head, rotations, len(sample.sketches)) {
+				merged.Merge(s)
+			}
+		}
+		quantiles := make(map[float64]float64, len(p.col.Quantiles))
+		for _, q := range p.col.Quantiles {
+			quantiles[q] = merged.Quantile(q)
+		}
+		ch <- prometheus.MustNewConstSummary(
+			p.prometheusDesc,
+			sample.count,
+			sample.sum,
+			quantiles,
+			sample.labelValues...,
+		)
+	}
+}
+
+func (p *SummaryProcessor) rotationInterval() time.Duration {
+	if p.col.MaxAge <= 0 {
+		return 0
+	}
+	return p.col.MaxAge / time.Duration(p.col.AgeBuckets)
+}
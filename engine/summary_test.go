@@ -0,0 +1,86 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rakyll/events2prom/event"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSummary(t *testing.T) {
+	p := NewSummaryProcessor(Collection{
+		Name:        "request_latency_ms",
+		Description: "Request latency in ms",
+		Event:       "request_latency_ms",
+		Labels:      []string{"region"},
+	})
+	var events []event.Event
+	for i := 1; i <= 100; i++ {
+		events = append(events, event.Event{
+			Name:   "request_latency_ms",
+			Labels: map[string]string{"region": "us-east-1"},
+			Value:  float64(i),
+		})
+	}
+	p.Handle(events)
+
+	s := p.samples["region_us-east-1_"]
+	assert.Equal(t, s.count, uint64(100))
+	assert.Equal(t, s.sum, 5050.0)
+	assert.InEpsilon(t, 50.5, s.sketches[0].Quantile(0.5), 0.02)
+	assert.InEpsilon(t, 99, s.sketches[0].Quantile(0.99), 0.02)
+}
+
+func TestSummary_maxAge(t *testing.T) {
+	now := time.Now()
+	p := NewSummaryProcessor(Collection{
+		Name:       "request_latency_ms",
+		Event:      "request_latency_ms",
+		MaxAge:     time.Minute,
+		AgeBuckets: 2,
+	})
+	p.now = func() time.Time { return now }
+
+	p.Handle([]event.Event{{Name: "request_latency_ms", Value: 100}})
+	now = now.Add(40 * time.Second)
+	p.Handle([]event.Event{{Name: "request_latency_ms", Value: 200}})
+
+	s := p.samples[""]
+	assert.Equal(t, s.sketches[0].Count()+s.sketches[1].Count(), uint64(2))
+
+	// The first value is now older than MaxAge.
+	now = now.Add(30 * time.Second)
+	p.Handle(nil)
+	assert.Equal(t, p.samples[""].head, s.head, "batches without events should be skipped")
+	ch := make(chan prometheus.Metric, 1)
+	p.Collect(ch)
+	var m dto.Metric
+	assert.NoError(t, (<-ch).Write(&m))
+	assert.InEpsilon(t, 200, m.GetSummary().GetQuantile()[0].GetValue(), 0.02, "rotated sketches should be skipped")
+
+	s.rotate(now, 30*time.Second, time.Minute)
+	assert.Equal(t, s.sketches[0].Count()+s.sketches[1].Count(), uint64(1))
+
+	now = now.Add(2 * time.Minute)
+	s.rotate(now, 30*time.Second, time.Minute)
+	assert.Equal(t, s.sketches[0].Count()+s.sketches[1].Count(), uint64(0))
+	assert.True(t, math.IsNaN(s.sketches[s.head].Quantile(0.5)))
+	assert.Equal(t, s.count, uint64(2))
+}
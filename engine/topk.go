@@ -0,0 +1,299 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rakyll/events2prom/event"
+)
+
+var _ Processor = &TopKProcessor{}
+
+const (
+	defaultTopK = 10
+
+	// topkCapacityFactor is the number of label sets tracked per
+	// exported label set. Label sets with more than 1/(factor*K)
+	// of the total are always tracked.
+	topkCapacityFactor = 10
+
+	topkOfEvents = "events"
+	topkOfValue  = "value"
+
+	// otherLabelValue is the value of all labels of
+	// the series of the label sets not in the top K.
+	otherLabelValue = "__other__"
+)
+
+type topkEntry struct {
+	series
+	key    string
+	weight float64 // count or sum, overestimated if it replaced another label set
+	index  int     // in the heap
+}
+
+// topkHeap is a min-heap of entries by weight.
+type topkHeap []*topkEntry
+
+func (h topkHeap) Len() int           { return len(h) }
+func (h topkHeap) Less(i, j int) bool { return h[i].weight < h[j].weight }
+func (h topkHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *topkHeap) Push(x any) {
+	e := x.(*topkEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *topkHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return e
+}
+
+// topkSnapshot is the published state of a TopKProcessor.
+type topkSnapshot struct {
+	top   []topkEntry // by weight, descending
+	other float64
+}
+
+// TopKProcessor exports the K label sets with the most events, or the
+// largest sum of values, with the space-saving algorithm. It tracks a
+// bounded number of label sets, and a new label set replaces the one
+// with the least weight, inheriting its weight as an overestimate.
+// The weight of all other label sets is exported as a series where
+// all labels are "__other__". Weights are exported as gauges, as
+// they go down when label sets move in and out of the top K.
+type TopKProcessor struct {
+	col      Collection
+	capacity int
+
+	entries map[string]*topkEntry // modified only in Handle
+	heap    topkHeap
+	total   float64
+
+	snapshot atomic.Pointer[topkSnapshot]
+
+	prometheusDesc *prometheus.Desc
+}
+
+func validateTopK(c Collection) error {
+	if c.K < 0 {
+		return errors.New("k should be positive")
+	}
+	if len(c.Labels) == 0 {
+		return errors.New("no labels")
+	}
+	switch c.TopKOf {
+	case "", topkOfEvents, topkOfValue:
+		return nil
+	}
+	return fmt.Errorf("unknown topk_of %q", c.TopKOf)
+}
+
+func NewTopKProcessor(c Collection) *TopKProcessor {
+	if c.K == 0 {
+		c.K = defaultTopK
+	}
+	if c.TopKOf == "" {
+		c.TopKOf = topkOfEvents
+	}
+	return &TopKProcessor{
+		col:            c,
+		capacity:       c.K * topkCapacityFactor,
+		entries:        make(map[string]*topkEntry),
+		prometheusDesc: prometheus.NewDesc(c.metricName(), c.Description, c.Labels, c.ConstLabels),
+	}
+}
+
+func (p *TopKProcessor) Collection() Collection {
+	return p.col
+}
+
+func (p *TopKProcessor) Handle(events []event.Event) {
+	now := time.Now()
+	if len(events) == 0 && !p.hasStale(now) {
+		return // nothing to aggregate or expire
+	}
+	p.expire(now)
+	for _, e := range events {
+		e, ok := p.col.Match(e)
+		if !ok {
+			continue
+		}
+		weight := 1.0
+		if p.col.TopKOf == topkOfValue {
+			if e.Value < 0 {
+				continue // weights only add up
+			}
+			weight = e.Value
+		}
+		p.add(e, weight, now)
+	}
+	p.publish()
+}
+
+// add adds weight to the label set of e. If the label set isn't
+// tracked and all entries are in use, the label set replaces the
+// one with the least weight.
+func (p *TopKProcessor) add(e event.Event, weight float64, now time.Time) {
+	p.total += weight
+	key, labelVals := generateKeyLabelVals(p.col, e)
+	if entry, ok := p.entries[key]; ok {
+		entry.weight += weight
+		entry.updated = now
+		heap.Fix(&p.heap, entry.index)
+		return
+	}
+	if len(p.heap) < p.capacity {
+		entry := &topkEntry{
+			series: series{labelValues: labelVals, updated: now},
+			key:    key,
+			weight: weight,
+		}
+		p.entries[key] = entry
+		heap.Push(&p.heap, entry)
+		return
+	}
+	least := p.heap[0]
+	delete(p.entries, least.key)
+	least.series = series{labelValues: labelVals, updated: now}
+	least.key = key
+	least.weight += weight
+	p.entries[key] = least
+	heap.Fix(&p.heap, 0)
+}
+
+func (p *TopKProcessor) hasStale(now time.Time) bool {
+	return hasStale(p.entries, p.col.TTL, now)
+}
+
+// expire stops tracking the label sets that have no events for longer
+// than the TTL. Their weight is folded into the other series.
+func (p *TopKProcessor) expire(now time.Time) {
+	if p.col.TTL <= 0 {
+		return
+	}
+	for key, entry := range p.entries {
+		if entry.isStale(p.col.TTL, now) {
+			delete(p.entries, key)
+			heap.Remove(&p.heap, entry.index)
+		}
+	}
+}
+
+// publish publishes the top K entries and the weight of all others.
+// Unlike samples, entries can't be double buffered, as the heap
+// modifies them in place and their order changes with every batch,
+// so they're copied instead. Copying costs at most the capacity, not
+// the label sets seen, as the heap tracks at most that many entries.
+func (p *TopKProcessor) publish() {
+	top := make([]topkEntry, len(p.heap))
+	for i, entry := range p.heap {
+		top[i] = *entry
+	}
+	sort.Slice(top, func(i, j int) bool { return top[i].weight > top[j].weight })
+	if len(top) > p.col.K {
+		top = top[:p.col.K]
+	}
+	other := p.total
+	for _, entry := range top {
+		other -= entry.weight
+	}
+	if other < 0 {
+		other = 0 // rounding errors
+	}
+	p.col.reportSeries(len(top) + 1)
+	p.snapshot.Store(&topkSnapshot{top: top, other: other})
+}
+
+func (p *TopKProcessor) CopySamples(old Processor) error {
+	o, err := updatedProcessor[*TopKProcessor](p, old)
+	if err != nil {
+		return err
+	}
+	if p.col.TopKOf != o.col.TopKOf {
+		return errors.New("topk_of changed")
+	}
+	p.total = o.total
+	for key, entry := range o.entries {
+		copied := *entry
+		p.entries[key] = &copied
+		p.heap = append(p.heap, &copied)
+	}
+	heap.Init(&p.heap)
+	for len(p.heap) > p.capacity {
+		delete(p.entries, heap.Pop(&p.heap).(*topkEntry).key)
+	}
+	p.publish()
+	return nil
+}
+
+// ResetSamples stops tracking the label sets that match all matchers.
+// The weight of the label sets no longer tracked is only reset if
+// there are no matchers, as it can't be told apart by labels.
+func (p *TopKProcessor) ResetSamples(matchers []LabelMatcher) {
+	for key, entry := range p.entries {
+		if entry.matches(p.col.Labels, matchers) {
+			delete(p.entries, key)
+			heap.Remove(&p.heap, entry.index)
+			p.total -= entry.weight
+		}
+	}
+	if len(matchers) == 0 {
+		p.total = 0 // including the label sets no longer tracked
+	}
+	p.publish()
+}
+
+func (p *TopKProcessor) Describe(ch chan<- *prometheus.Desc) {
+	ch <- p.prometheusDesc
+}
+
+func (p *TopKProcessor) Collect(ch chan<- prometheus.Metric) {
+	s := p.snapshot.Load()
+	if s == nil {
+		return
+	}
+	now := time.Now()
+	for _, entry := range s.top {
+		if entry.isStale(p.col.TTL, now) {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(
+			p.prometheusDesc,
+			prometheus.GaugeValue,
+			entry.weight,
+			entry.labelValues...,
+		)
+	}
+	otherVals := make([]string, len(p.col.Labels))
+	for i := range otherVals {
+		otherVals[i] = otherLabelValue
+	}
+	ch <- prometheus.MustNewConstMetric(p.prometheusDesc, prometheus.GaugeValue, s.other, otherVals...)
+}
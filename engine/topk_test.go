@@ -0,0 +1,99 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rakyll/events2prom/event"
+	"github.com/stretchr/testify/assert"
+)
+
+func collectTopK(t *testing.T, p *TopKProcessor) map[string]float64 {
+	ch := make(chan prometheus.Metric, 64)
+	p.Collect(ch)
+	close(ch)
+
+	values := make(map[string]float64)
+	for m := range ch {
+		var pb dto.Metric
+		assert.NoError(t, m.Write(&pb))
+		values[pb.GetLabel()[0].GetValue()] = pb.GetGauge().GetValue()
+	}
+	return values
+}
+
+func TestTopK(t *testing.T) {
+	p := NewTopKProcessor(Collection{
+		Name:   "requests_by_customer",
+		Event:  "request",
+		Labels: []string{"customer_id"},
+		K:      2,
+	})
+	request := func(customer string) event.Event {
+		return event.Event{Name: "request", Labels: map[string]string{"customer_id": customer}}
+	}
+	var events []event.Event
+	for i := 0; i < 100; i++ {
+		events = append(events, request(fmt.Sprintf("customer-%d", i)))
+	}
+	for i := 0; i < 50; i++ {
+		events = append(events, request("a"), request("b"), request("b"))
+	}
+	p.Handle(events)
+
+	values := collectTopK(t, p)
+	assert.Len(t, values, 3)
+	assert.GreaterOrEqual(t, values["b"], 100.0)
+	assert.GreaterOrEqual(t, values["a"], 50.0)
+	assert.Equal(t, values["b"]+values["a"]+values[otherLabelValue], 250.0)
+	assert.Len(t, p.entries, 20)
+
+	b := values["b"]
+	p.ResetSamples([]LabelMatcher{{Name: "customer_id", Op: "=", Value: "b"}})
+	values = collectTopK(t, p)
+	assert.NotContains(t, values, "b")
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	assert.Equal(t, sum, 250.0-b)
+}
+
+func TestTopK_value(t *testing.T) {
+	p := NewTopKProcessor(Collection{
+		Name:   "bytes_by_url",
+		Event:  "response_size",
+		Labels: []string{"url"},
+		K:      1,
+		TopKOf: "value",
+	})
+	p.Handle([]event.Event{
+		{Name: "response_size", Labels: map[string]string{"url": "/"}, Value: 10},
+		{Name: "response_size", Labels: map[string]string{"url": "/"}, Value: 10},
+		{Name: "response_size", Labels: map[string]string{"url": "/video"}, Value: 500},
+		{Name: "response_size", Labels: map[string]string{"url": "/video"}, Value: -1},
+	})
+	assert.Equal(t, collectTopK(t, p), map[string]float64{"/video": 500, otherLabelValue: 20})
+}
+
+func TestValidateTopK(t *testing.T) {
+	assert.NoError(t, validateTopK(Collection{Labels: []string{"url"}}))
+	assert.Error(t, validateTopK(Collection{}))
+	assert.Error(t, validateTopK(Collection{Labels: []string{"url"}, K: -1}))
+	assert.Error(t, validateTopK(Collection{Labels: []string{"url"}, TopKOf: "bytes"}))
+}
@@ -0,0 +1,168 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+type unit struct {
+	dimension string
+	factor    float64 // in the base unit of the dimension
+	name      string  // used as the metric name suffix
+}
+
+var units = map[string]unit{}
+
+func init() {
+	for _, u := range []struct {
+		unit
+		aliases []string
+	}{
+		{unit{"time", 1e-9, "nanoseconds"}, []string{"ns"}},
+		{unit{"time", 1e-6, "microseconds"}, []string{"us", "µs"}},
+		{unit{"time", 1e-3, "milliseconds"}, []string{"ms"}},
+		{unit{"time", 1, "seconds"}, []string{"s"}},
+		{unit{"time", 60, "minutes"}, []string{"m", "min"}},
+		{unit{"time", 3600, "hours"}, []string{"h"}},
+		{unit{"data", 1, "bytes"}, []string{"B"}},
+		{unit{"data", 1e3, "kilobytes"}, []string{"KB"}},
+		{unit{"data", 1e6, "megabytes"}, []string{"MB"}},
+		{unit{"data", 1e9, "gigabytes"}, []string{"GB"}},
+		{unit{"data", 1 << 10, "kibibytes"}, []string{"KiB"}},
+		{unit{"data", 1 << 20, "mebibytes"}, []string{"MiB"}},
+		{unit{"data", 1 << 30, "gibibytes"}, []string{"GiB"}},
+		{unit{"ratio", 1, "ratio"}, nil},
+		{unit{"ratio", 1e-2, "percent"}, []string{"%"}},
+	} {
+		units[u.name] = u.unit
+		for _, alias := range u.aliases {
+			units[alias] = u.unit
+		}
+	}
+}
+
+// Transform converts the values of events before they are aggregated,
+// after the events are filtered. Values are scaled, converted from one
+// unit to another, passed to Func and clamped, in this order.
+type Transform struct {
+	Scale float64 `json:"scale,omitempty" yaml:"scale,omitempty"` // not scaled if zero
+
+	// From and To are units such as ns, ms, seconds, bytes or MiB.
+	// The unit of the metric is To, or From if To is empty. The metric
+	// name is suffixed with the unit, e.g. _seconds, unless it already is.
+	From string `json:"from,omitempty" yaml:"from,omitempty"`
+	To   string `json:"to,omitempty" yaml:"to,omitempty"`
+
+	Func string   `json:"func,omitempty" yaml:"func,omitempty"` // abs, log, log2 or log10
+	Min  *float64 `json:"min,omitempty" yaml:"min,omitempty"`
+	Max  *float64 `json:"max,omitempty" yaml:"max,omitempty"`
+}
+
+func (t *Transform) validate() error {
+	if t == nil {
+		return nil
+	}
+	from, ok := units[t.From]
+	if t.From != "" && !ok {
+		return fmt.Errorf("unknown unit %q", t.From)
+	}
+	to, ok := units[t.To]
+	if t.To != "" && !ok {
+		return fmt.Errorf("unknown unit %q", t.To)
+	}
+	if t.From != "" && t.To != "" && from.dimension != to.dimension {
+		return fmt.Errorf("can't convert %q to %q", t.From, t.To)
+	}
+	switch t.Func {
+	case "", "abs", "log", "log2", "log10":
+	default:
+		return fmt.Errorf("unknown func %q", t.Func)
+	}
+	if t.Min != nil && t.Max != nil && *t.Min > *t.Max {
+		return errors.New("min is larger than max")
+	}
+	return nil
+}
+
+func (t *Transform) apply(v float64) float64 {
+	if t == nil {
+		return v
+	}
+	if t.Scale != 0 {
+		v *= t.Scale
+	}
+	if t.From != "" && t.To != "" {
+		v = v * units[t.From].factor / units[t.To].factor
+	}
+	switch t.Func {
+	case "abs":
+		v = math.Abs(v)
+	case "log":
+		v = math.Log(v)
+	case "log2":
+		v = math.Log2(v)
+	case "log10":
+		v = math.Log10(v)
+	}
+	if t.Min != nil && v < *t.Min {
+		v = *t.Min
+	}
+	if t.Max != nil && v > *t.Max {
+		v = *t.Max
+	}
+	return v
+}
+
+// unit returns the name of the unit of the transformed
+// values, or an empty string if they have no unit.
+func (t *Transform) unit() string {
+	switch {
+	case t == nil:
+		return ""
+	case t.To != "":
+		return units[t.To].name
+	case t.From != "":
+		return units[t.From].name
+	}
+	return ""
+}
+
+// unit returns the unit of the values exported for c, which is
+// the unit of the transformed values only if c aggregates them
+// into values, e.g. not for counts and rates.
+func (c Collection) unit() string {
+	switch c.Aggregation {
+	case "sum", "gauge", "min", "max", "avg", "histogram", "summary":
+		return c.Transform.unit()
+	case "topk":
+		if c.TopKOf == topkOfValue {
+			return c.Transform.unit()
+		}
+	}
+	return ""
+}
+
+// metricName returns the name of the metric exported
+// for c, suffixed with the unit of c if any.
+func (c Collection) metricName() string {
+	u := c.unit()
+	if u == "" || strings.HasSuffix(c.Name, "_"+u) {
+		return c.Name
+	}
+	return c.Name + "_" + u
+}
@@ -0,0 +1,91 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"math"
+	"testing"
+
+	"github.com/rakyll/events2prom/event"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransform(t *testing.T) {
+	zero, hundred := 0.0, 100.0
+	tests := []struct {
+		name      string
+		transform *Transform
+		in, want  float64
+	}{
+		{name: "none", in: 5, want: 5},
+		{name: "scale", transform: &Transform{Scale: 0.5}, in: 5, want: 2.5},
+		{name: "ns to s", transform: &Transform{From: "ns", To: "seconds"}, in: 2.5e9, want: 2.5},
+		{name: "bytes to MiB", transform: &Transform{From: "bytes", To: "MiB"}, in: 3 << 20, want: 3},
+		{name: "abs", transform: &Transform{Func: "abs"}, in: -5, want: 5},
+		{name: "log10", transform: &Transform{Func: "log10"}, in: 1000, want: 3},
+		{name: "min", transform: &Transform{Min: &zero, Max: &hundred}, in: -5, want: 0},
+		{name: "max", transform: &Transform{Min: &zero, Max: &hundred}, in: 500, want: 100},
+		{name: "all", transform: &Transform{Scale: 1000, From: "us", To: "ms", Max: &hundred}, in: 0.05, want: 0.05},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.NoError(t, tt.transform.validate())
+			assert.InDelta(t, tt.want, tt.transform.apply(tt.in), 1e-9)
+		})
+	}
+	assert.True(t, math.IsInf((&Transform{Func: "log"}).apply(0), -1))
+}
+
+func TestTransform_invalid(t *testing.T) {
+	zero, hundred := 0.0, 100.0
+	assert.Error(t, (&Transform{From: "parsecs"}).validate())
+	assert.Error(t, (&Transform{From: "ms", To: "bytes"}).validate())
+	assert.Error(t, (&Transform{Func: "sqrt"}).validate())
+	assert.Error(t, (&Transform{Min: &hundred, Max: &zero}).validate())
+}
+
+func TestMetricName(t *testing.T) {
+	assert.Equal(t, Collection{Name: "request_latency", Aggregation: "sum"}.metricName(), "request_latency")
+	assert.Equal(t, Collection{Name: "request_latency", Aggregation: "histogram", Transform: &Transform{From: "ns", To: "s"}}.metricName(), "request_latency_seconds")
+	assert.Equal(t, Collection{Name: "request_latency_seconds", Aggregation: "max", Transform: &Transform{To: "seconds"}}.metricName(), "request_latency_seconds")
+	assert.Equal(t, Collection{Name: "response_size", Aggregation: "topk", TopKOf: topkOfValue, Transform: &Transform{From: "B"}}.metricName(), "response_size_bytes")
+
+	// Counts and rates aren't in the unit of the values.
+	assert.Equal(t, Collection{Name: "requests", Aggregation: "count", Transform: &Transform{From: "ms", To: "s"}}.metricName(), "requests")
+	assert.Equal(t, Collection{Name: "requests", Aggregation: "rate", Transform: &Transform{From: "ms", To: "s"}}.metricName(), "requests")
+	assert.Equal(t, Collection{Name: "requests", Aggregation: "topk", Transform: &Transform{From: "ms", To: "s"}}.metricName(), "requests")
+}
+
+func TestLoop_units(t *testing.T) {
+	l := NewLoop(16, nil, nil, nil)
+	l.enableCollection(Collection{
+		Name:        "request_latency",
+		Aggregation: "sum",
+		Event:       "request_latency_ns",
+		Transform:   &Transform{From: "ns", To: "s"},
+	})
+	l.handleEvent(event.Event{Name: "request_latency_ns", Value: 1.5e9})
+	l.flush(newStoppedTimer())
+
+	mfs, err := l.Gatherer().Gather()
+	assert.NoError(t, err)
+	for _, mf := range mfs {
+		if mf.GetName() == "request_latency_seconds" {
+			assert.Equal(t, mf.GetUnit(), "seconds")
+			assert.Equal(t, mf.GetMetric()[0].GetGauge().GetValue(), 1.5)
+			return
+		}
+	}
+	t.Fatal("request_latency_seconds is not gathered")
+}
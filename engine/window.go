@@ -0,0 +1,385 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rakyll/events2prom/event"
+)
+
+var _ Processor = &WindowedProcessor{}
+
+const (
+	windowTumbling = "tumbling"
+	windowSliding  = "sliding"
+
+	defaultWindowBuckets = 10
+)
+
+func validateWindow(c Collection) error {
+	switch c.Aggregation {
+	case "count", "sum", "min", "max", "histogram":
+	default:
+		return fmt.Errorf("not supported for %q aggregation", c.Aggregation)
+	}
+	if c.NativeHistogram != nil {
+		return errors.New("not supported for native histograms")
+	}
+	if c.Reset != "" {
+		return errors.New("not supported with reset")
+	}
+	w := c.Window
+	switch w.Type {
+	case "", windowTumbling, windowSliding:
+	default:
+		return fmt.Errorf("unknown type %q", w.Type)
+	}
+	if w.Size <= 0 {
+		return errors.New("size should be positive")
+	}
+	if w.Buckets < 0 {
+		return errors.New("buckets should be positive")
+	}
+	return nil
+}
+
+// WindowedProcessor aggregates events in a tumbling or a sliding
+// window. It keeps a ring of processors, each aggregating the events
+// of a sub-window, and merges them when collected. Counts, sums, minimums
+// and maximums are exported as gauges as they go down when the window moves.
+type WindowedProcessor struct {
+	col          Collection
+	newProcessor func(Collection) Processor
+
+	ring         []Processor // ring[head] is receiving events, modified only in Handle
+	head         int
+	interval     time.Duration
+	nextRotation time.Time
+	now          func() time.Time
+	series       *windowSeries
+
+	// snapshot is read by Collect, which skips the sub-windows
+	// that are due to rotate rather than rotating them.
+	snapshot atomic.Pointer[windowSnapshot]
+
+	prometheusDesc *prometheus.Desc
+}
+
+// seriesKeyer is implemented by the processors of sub-windows,
+// so the series of the whole window can be counted.
+type seriesKeyer interface {
+	seriesKeys() []string
+}
+
+// windowSeries counts the series of a window, as a label set in
+// several sub-windows is exported as a single series. Sub-windows add
+// their new series to it, see Collection.isFull, so the series of the
+// whole window are limited rather than those of each sub-window.
+// Series expired in a sub-window are counted until it's rotated.
+type windowSeries struct {
+	col    Collection     // of the window
+	counts map[string]int // by key, times added to sub-windows
+	keys   [][]string     // added, by sub-window
+	head   int
+}
+
+func newWindowSeries(c Collection, n int) *windowSeries {
+	return &windowSeries{
+		col:    c,
+		counts: make(map[string]int),
+		keys:   make([][]string, n),
+	}
+}
+
+// add adds the series with the given key to the sub-window receiving
+// events, unless it's new to the window and the window is full.
+func (s *windowSeries) add(key string) bool {
+	if s.counts[key] == 0 && s.col.isFull(key, len(s.counts)) {
+		return false
+	}
+	s.counts[key]++
+	s.keys[s.head] = append(s.keys[s.head], key)
+	return true
+}
+
+// remove removes the series of the sub-window i.
+func (s *windowSeries) remove(i int) {
+	for _, key := range s.keys[i] {
+		s.counts[key]--
+		if s.counts[key] == 0 {
+			delete(s.counts, key)
+		}
+	}
+	s.keys[i] = s.keys[i][:0]
+}
+
+// recount counts the series of the sub-windows in ring, e.g.
+// when their samples are copied or reset outside of Handle.
+func (s *windowSeries) recount(ring []Processor) {
+	clear(s.counts)
+	for i, sub := range ring {
+		s.keys[i] = s.keys[i][:0]
+		if keyer, ok := sub.(seriesKeyer); ok {
+			for _, key := range keyer.seriesKeys() {
+				s.counts[key]++
+				s.keys[i] = append(s.keys[i], key)
+			}
+		}
+	}
+}
+
+// windowSnapshot is the published state of a WindowedProcessor.
+type windowSnapshot struct {
+	ring         []Processor
+	head         int
+	nextRotation time.Time
+}
+
+// NewWindowedProcessor returns a processor that aggregates the events
+// in c.Window with the processors returned by newProcessor.
+func NewWindowedProcessor(c Collection, newProcessor func(Collection) Processor) *WindowedProcessor {
+	w := *c.Window
+	if w.Type == "" {
+		w.Type = windowTumbling
+	}
+	switch w.Type {
+	case windowTumbling:
+		w.Buckets = 1
+	case windowSliding:
+		if w.Buckets == 0 {
+			w.Buckets = defaultWindowBuckets
+		}
+	}
+	c.Window = &w
+
+	p := &WindowedProcessor{
+		col:            c,
+		newProcessor:   newProcessor,
+		ring:           make([]Processor, w.Buckets),
+		interval:       w.Size / time.Duration(w.Buckets),
+		now:            time.Now,
+		series:         newWindowSeries(c, w.Buckets),
+		prometheusDesc: prometheus.NewDesc(c.metricName(), c.Description, c.Labels, c.ConstLabels),
+	}
+	for i := range p.ring {
+		p.ring[i] = p.newSubProcessor()
+	}
+	p.nextRotation = p.now().Add(p.interval)
+	return p
+}
+
+func (p *WindowedProcessor) Collection() Collection {
+	return p.col
+}
+
+func (p *WindowedProcessor) Handle(events []event.Event) {
+	p.rotate()
+	p.ring[p.head].Handle(events)
+	p.col.reportSeries(len(p.series.counts))
+	p.snapshot.Store(&windowSnapshot{
+		ring:         append([]Processor(nil), p.ring...),
+		head:         p.head,
+		nextRotation: p.nextRotation,
+	})
+}
+
+func (p *WindowedProcessor) CopySamples(old Processor) error {
+	o, err := updatedProcessor[*WindowedProcessor](p, old)
+	if err != nil {
+		return err
+	}
+	for i, sub := range p.ring {
+		copier, ok := sub.(SamplesCopier)
+		if !ok {
+			return fmt.Errorf("%q aggregation can't copy samples", p.col.Aggregation)
+		}
+		if err := copier.CopySamples(o.ring[i]); err != nil {
+			return err
+		}
+	}
+	p.head = o.head
+	p.nextRotation = o.nextRotation
+	p.series.head = p.head
+	p.series.recount(p.ring)
+	p.col.reportSeries(len(p.series.counts))
+	p.snapshot.Store(&windowSnapshot{
+		ring:         append([]Processor(nil), p.ring...),
+		head:         p.head,
+		nextRotation: p.nextRotation,
+	})
+	return nil
+}
+
+func (p *WindowedProcessor) ResetSamples(matchers []LabelMatcher) {
+	for _, sub := range p.ring {
+		if resetter, ok := sub.(SamplesResetter); ok {
+			resetter.ResetSamples(matchers)
+		}
+	}
+	p.series.recount(p.ring)
+	p.col.reportSeries(len(p.series.counts))
+}
+
+func (p *WindowedProcessor) Describe(ch chan<- *prometheus.Desc) {
+	ch <- p.prometheusDesc
+}
+
+type windowSample struct {
+	labelValues []string
+	value       float64
+	count       uint64
+	sum         float64
+	buckets     map[float64]uint64
+}
+
+func (p *WindowedProcessor) Collect(ch chan<- prometheus.Metric) {
+	snapshot := p.snapshot.Load()
+	if snapshot == nil {
+		return
+	}
+	n := len(snapshot.ring)
+	rotations := pendingRotations(p.now(), snapshot.nextRotation, p.interval, p.col.Window.Size, n)
+	samples := make(map[string]*windowSample, 64)
+	for i, sub := range snapshot.ring {
+		if isRotated(i, snapshot.head, rotations, n) {
+			continue
+		}
+		metrics := make(chan prometheus.Metric, 64)
+		go func(sub Processor) {
+			sub.Collect(metrics)
+			close(metrics)
+		}(sub)
+		for m := range metrics {
+			var pb dto.Metric
+			if err := m.Write(&pb); err != nil {
+				continue
+			}
+			p.merge(samples, &pb)
+		}
+	}
+
+	for _, s := range samples {
+		if p.col.Aggregation == "histogram" {
+			ch <- prometheus.MustNewConstHistogram(
+				p.prometheusDesc,
+				s.count,
+				s.sum,
+				s.buckets,
+				s.labelValues...,
+			)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(
+			p.prometheusDesc,
+			prometheus.GaugeValue,
+			s.value,
+			s.labelValues...,
+		)
+	}
+}
+
+// merge merges the sub-window metric pb into samples.
+func (p *WindowedProcessor) merge(samples map[string]*windowSample, pb *dto.Metric) {
+	labels := make(map[string]string, len(pb.GetLabel()))
+	for _, l := range pb.GetLabel() {
+		labels[l.GetName()] = l.GetValue()
+	}
+	labelVals := make([]string, len(p.col.Labels))
+	for i, label := range p.col.Labels {
+		labelVals[i] = labels[label]
+	}
+	key := generateKey(p.col.Labels, labelVals)
+
+	var value float64
+	if pb.Counter != nil {
+		value = pb.Counter.GetValue()
+	} else {
+		value = pb.Gauge.GetValue()
+	}
+
+	s, ok := samples[key]
+	if !ok {
+		s = &windowSample{labelValues: labelVals, value: value}
+		if p.col.Aggregation == "histogram" {
+			s.buckets = make(map[float64]uint64)
+		}
+		samples[key] = s
+	} else {
+		switch p.col.Aggregation {
+		case "count", "sum":
+			s.value += value
+		case "min":
+			if value < s.value {
+				s.value = value
+			}
+		case "max":
+			if value > s.value {
+				s.value = value
+			}
+		}
+	}
+	if h := pb.Histogram; h != nil {
+		s.count += h.GetSampleCount()
+		s.sum += h.GetSampleSum()
+		for _, b := range h.GetBucket() {
+			s.buckets[b.GetUpperBound()] += b.GetCumulativeCount()
+		}
+	}
+}
+
+// rotate replaces the oldest sub-window with an empty one for
+// each interval passed. It should only be called from Handle.
+func (p *WindowedProcessor) rotate() {
+	now := p.now()
+	if now.Sub(p.nextRotation) >= p.col.Window.Size {
+		// All sub-windows are older than the window.
+		for i := range p.ring {
+			p.ring[i] = p.newSubProcessor()
+			p.series.remove(i)
+		}
+		p.nextRotation = now.Add(p.interval)
+		return
+	}
+	for !now.Before(p.nextRotation) {
+		p.head = (p.head + 1) % len(p.ring)
+		p.ring[p.head] = p.newSubProcessor()
+		p.series.remove(p.head)
+		p.series.head = p.head
+		p.nextRotation = p.nextRotation.Add(p.interval)
+	}
+}
+
+func (p *WindowedProcessor) newSubProcessor() Processor {
+	c := p.col
+	c.Window = nil
+	c.MaxSeries = 0
+	c.limiter = nil // series are limited and reported by the window
+	c.window = p.series
+	return p.newProcessor(c)
+}
+
+// sampleKeys returns the keys of samples.
+func sampleKeys[S any](samples map[string]S) []string {
+	keys := make([]string, 0, len(samples))
+	for key := range samples {
+		keys = append(keys, key)
+	}
+	return keys
+}
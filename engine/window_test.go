@@ -0,0 +1,185 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rakyll/events2prom/event"
+	"github.com/stretchr/testify/assert"
+)
+
+func collectWindow(t *testing.T, p *WindowedProcessor) map[string]*dto.Metric {
+	ch := make(chan prometheus.Metric, 64)
+	p.Collect(ch)
+	close(ch)
+
+	metrics := make(map[string]*dto.Metric)
+	for m := range ch {
+		var pb dto.Metric
+		assert.NoError(t, m.Write(&pb))
+		var key string
+		for _, l := range pb.GetLabel() {
+			key += l.GetValue()
+		}
+		metrics[key] = &pb
+	}
+	return metrics
+}
+
+func newTestWindow(c Collection, now *time.Time) *WindowedProcessor {
+	p := NewWindowedProcessor(c, mustNewProcessor)
+	p.now = func() time.Time { return *now }
+	p.nextRotation = now.Add(p.interval)
+	return p
+}
+
+func TestWindow_tumbling(t *testing.T) {
+	now := time.Now()
+	p := newTestWindow(Collection{
+		Name:        "requests_last_minute",
+		Aggregation: "count",
+		Event:       "request",
+		Labels:      []string{"region"},
+		Window:      &Window{Size: time.Minute},
+	}, &now)
+
+	request := event.Event{Name: "request", Labels: map[string]string{"region": "us-east-1"}}
+	p.Handle([]event.Event{request, request})
+	now = now.Add(30 * time.Second)
+	p.Handle([]event.Event{request})
+	assert.Equal(t, collectWindow(t, p)["us-east-1"].GetGauge().GetValue(), 3.0)
+
+	now = now.Add(40 * time.Second)
+	p.Handle([]event.Event{request})
+	assert.Equal(t, collectWindow(t, p)["us-east-1"].GetGauge().GetValue(), 1.0)
+}
+
+func TestWindow_sliding(t *testing.T) {
+	now := time.Now()
+	p := newTestWindow(Collection{
+		Name:        "latency_max_last_minute",
+		Aggregation: "max",
+		Event:       "latency",
+		Window:      &Window{Type: windowSliding, Size: time.Minute, Buckets: 4},
+	}, &now)
+
+	p.Handle([]event.Event{{Name: "latency", Value: 500}})
+	now = now.Add(30 * time.Second)
+	p.Handle([]event.Event{{Name: "latency", Value: 100}})
+	assert.Equal(t, collectWindow(t, p)[""].GetGauge().GetValue(), 500.0)
+
+	// The first sub-window has moved out of the window.
+	now = now.Add(31 * time.Second)
+	assert.Equal(t, collectWindow(t, p)[""].GetGauge().GetValue(), 100.0)
+
+	now = now.Add(time.Hour)
+	assert.Empty(t, collectWindow(t, p))
+}
+
+func TestWindow_histogram(t *testing.T) {
+	now := time.Now()
+	p := newTestWindow(Collection{
+		Name:        "latency_last_minute",
+		Aggregation: "histogram",
+		Event:       "latency",
+		Buckets:     []float64{100, 200},
+		Window:      &Window{Type: windowSliding, Size: time.Minute, Buckets: 2},
+	}, &now)
+
+	p.Handle([]event.Event{{Name: "latency", Value: 50}})
+	now = now.Add(30 * time.Second)
+	p.Handle([]event.Event{{Name: "latency", Value: 150}, {Name: "latency", Value: 250}})
+
+	h := collectWindow(t, p)[""].GetHistogram()
+	assert.Equal(t, h.GetSampleCount(), uint64(3))
+	assert.Equal(t, h.GetSampleSum(), 450.0)
+	assert.Equal(t, h.GetBucket()[0].GetCumulativeCount(), uint64(1))
+	assert.Equal(t, h.GetBucket()[1].GetCumulativeCount(), uint64(2))
+}
+
+func TestWindow_reportSeries(t *testing.T) {
+	now := time.Now()
+	limiter := newSeriesLimiter(0)
+	p := newTestWindow(Collection{
+		Name:        "requests_last_minute",
+		Aggregation: "count",
+		Event:       "request",
+		Labels:      []string{"region"},
+		Window:      &Window{Type: windowSliding, Size: time.Minute, Buckets: 2},
+		limiter:     limiter,
+	}, &now)
+
+	p.Handle([]event.Event{
+		{Name: "request", Labels: map[string]string{"region": "us-east-1"}},
+		{Name: "request", Labels: map[string]string{"region": "eu-west-1"}},
+	})
+	now = now.Add(30 * time.Second)
+	p.Handle([]event.Event{
+		{Name: "request", Labels: map[string]string{"region": "us-east-1"}},
+		{Name: "request", Labels: map[string]string{"region": "ap-south-1"}},
+	})
+	assert.Equal(t, 3, limiter.counts["requests_last_minute"])
+
+	// The first sub-window has moved out of the window.
+	now = now.Add(30 * time.Second)
+	p.Handle(nil)
+	assert.Equal(t, 2, limiter.counts["requests_last_minute"])
+}
+
+func TestWindow_maxSeries(t *testing.T) {
+	now := time.Now()
+	limiter := newSeriesLimiter(3)
+	p := newTestWindow(Collection{
+		Name:        "requests_last_minute",
+		Aggregation: "count",
+		Event:       "request",
+		Labels:      []string{"region"},
+		Window:      &Window{Type: windowSliding, Size: time.Minute, Buckets: 2},
+		MaxSeries:   2,
+		limiter:     limiter,
+	}, &now)
+
+	p.Handle([]event.Event{
+		{Name: "request", Labels: map[string]string{"region": "us-east-1"}},
+		{Name: "request", Labels: map[string]string{"region": "eu-west-1"}},
+	})
+	now = now.Add(30 * time.Second)
+	p.Handle([]event.Event{
+		{Name: "request", Labels: map[string]string{"region": "us-east-1"}},
+		{Name: "request", Labels: map[string]string{"region": "ap-south-1"}},
+	})
+	head := p.ring[p.head].(*CountProcessor)
+	assert.Contains(t, head.samples, "region_us-east-1_", "series of other sub-windows should be aggregated")
+	assert.Contains(t, head.samples, "region___overflow___")
+	assert.NotContains(t, head.samples, "region_ap-south-1_")
+
+	// The first sub-window has moved out of the window.
+	now = now.Add(30 * time.Second)
+	p.Handle([]event.Event{{Name: "request", Labels: map[string]string{"region": "ap-south-1"}}})
+	head = p.ring[p.head].(*CountProcessor)
+	assert.Contains(t, head.samples, "region_ap-south-1_")
+	assert.Equal(t, 2, limiter.counts["requests_last_minute"])
+}
+
+func TestValidateWindow(t *testing.T) {
+	assert.NoError(t, validateWindow(Collection{Aggregation: "sum", Window: &Window{Size: time.Minute}}))
+	assert.Error(t, validateWindow(Collection{Aggregation: "summary", Window: &Window{Size: time.Minute}}))
+	assert.Error(t, validateWindow(Collection{Aggregation: "sum", Window: &Window{}}))
+	assert.Error(t, validateWindow(Collection{Aggregation: "sum", Window: &Window{Type: "hopping", Size: time.Minute}}))
+	assert.Error(t, validateWindow(Collection{Aggregation: "max", Reset: resetOnScrape, Window: &Window{Size: time.Minute}}))
+}
@@ -17,6 +17,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"math"
 	"strconv"
 	"time"
 
@@ -25,17 +26,37 @@ import (
 
 var fastParser fastjson.Parser
 
+// TraceIDLabel is a reserved label. Parsers move it from the
+// labels to the exemplar of an event, so it never identifies series.
+const TraceIDLabel = "trace_id"
+
+// exemplarPrefix marks the exemplar labels in the text format,
+// e.g. request_latency_ms|54.7|0|region:us-east-1|#span_id:00f067aa.
+const exemplarPrefix = '#'
+
 type Event struct {
 	Name      string            `json:"event,omitempty"`
 	Labels    map[string]string `json:"labels,omitempty"` // label keys should match the regex [a-zA-Z0-9_]*
 	Value     float64           `json:"value,omitempty"`
 	Timestamp time.Time         `json:"ts,omitempty"`
+
+	// Exemplar labels the event for exemplars, e.g. with the trace
+	// of the request. They are not aggregated as labels.
+	Exemplar map[string]string `json:"exemplar,omitempty"`
+
+	// Delta reports whether Value changes a gauge rather than sets it.
+	// Parsers set it for signed values, e.g. +5 or -3, like StatsD,
+	// so negative values are always deltas in the text format.
+	Delta bool `json:"delta,omitempty"`
 }
 
 func (e Event) Text() string {
 	var buf bytes.Buffer
 	buf.WriteString(e.Name)
 	buf.WriteByte('|')
+	if e.Delta && !math.Signbit(e.Value) {
+		buf.WriteByte('+')
+	}
 	buf.WriteString(strconv.FormatFloat(e.Value, 'f', -1, 64))
 	buf.WriteByte('|')
 	buf.WriteString(strconv.FormatInt(e.Timestamp.UnixNano(), 10))
@@ -45,6 +66,13 @@ func (e Event) Text() string {
 		buf.WriteByte(':')
 		buf.WriteString(v)
 	}
+	for k, v := range e.Exemplar {
+		buf.WriteByte('|')
+		buf.WriteByte(exemplarPrefix)
+		buf.WriteString(k)
+		buf.WriteByte(':')
+		buf.WriteString(v)
+	}
 	return buf.String()
 }
 
@@ -55,20 +83,58 @@ func ParseJSON(buf []byte) (Event, error) {
 	}
 	name := string(v.GetStringBytes("event"))
 	value := v.GetFloat64("value")
+	var delta bool
+	if s := v.GetStringBytes("value"); s != nil {
+		// Deltas are strings, as JSON numbers can't start with +.
+		if value, err = strconv.ParseFloat(string(s), 64); err != nil {
+			return Event{}, err
+		}
+		delta = isSigned(s)
+	}
 	o, err := v.Object()
 	if err != nil {
 		return Event{}, err
 	}
 
 	labels := make(map[string]string)
+	var exemplar map[string]string
+	var exemplarErr error
+	addExemplar := func(k []byte, v *fastjson.Value) {
+		value, err := exemplarValue(k, v)
+		if err != nil {
+			if exemplarErr == nil {
+				exemplarErr = err
+			}
+			return
+		}
+		exemplar = addExemplarLabel(exemplar, string(k), value)
+	}
 	o.Visit(func(k []byte, v *fastjson.Value) {
-		labels[string(k)] = v.String()
+		switch string(k) {
+		case "exemplar":
+		case TraceIDLabel:
+			addExemplar(k, v)
+		default:
+			labels[string(k)] = v.String()
+		}
 	})
+	if ev := v.Get("exemplar"); ev != nil {
+		eo, err := ev.Object()
+		if err != nil {
+			return Event{}, fmt.Errorf("invalid exemplar: %v", err)
+		}
+		eo.Visit(addExemplar)
+	}
+	if exemplarErr != nil {
+		return Event{}, exemplarErr
+	}
 	// TODO(jbd): Handle timestamp.
 	return Event{
-		Name:   name,
-		Value:  value,
-		Labels: labels,
+		Name:     name,
+		Value:    value,
+		Labels:   labels,
+		Exemplar: exemplar,
+		Delta:    delta,
 	}, nil
 }
 
@@ -87,18 +153,57 @@ func Parse(buf []byte) (Event, error) {
 	}
 
 	labels := make(map[string]string, len(sections)-minSections)
+	var exemplar map[string]string
 	for i := minSections; i < len(sections); i++ {
 		keyValue := sections[i]
 		idx := bytes.IndexByte(keyValue, byte(':'))
 		if idx <= 0 {
 			return Event{}, fmt.Errorf("invalid label: %s", keyValue)
 		}
-		labels[string(keyValue[:idx])] = string(keyValue[idx+1:])
+		key, v := string(keyValue[:idx]), string(keyValue[idx+1:])
+		switch {
+		case key[0] == exemplarPrefix:
+			if len(key) == 1 {
+				return Event{}, fmt.Errorf("invalid exemplar label: %s", keyValue)
+			}
+			exemplar = addExemplarLabel(exemplar, key[1:], v)
+		case key == TraceIDLabel:
+			exemplar = addExemplarLabel(exemplar, key, v)
+		default:
+			labels[key] = v
+		}
 	}
 	// TODO(jbd): Handle timestamp.
 	return Event{
-		Name:   name,
-		Value:  value,
-		Labels: labels,
+		Name:     name,
+		Value:    value,
+		Labels:   labels,
+		Exemplar: exemplar,
+		Delta:    isSigned(sections[1]),
 	}, nil
 }
+
+// isSigned reports whether the value starts with a sign.
+func isSigned(value []byte) bool {
+	return len(value) > 0 && (value[0] == '+' || value[0] == '-')
+}
+
+// exemplarValue returns the value of the exemplar label k in JSON.
+// Numbers and booleans are converted to strings.
+func exemplarValue(k []byte, v *fastjson.Value) (string, error) {
+	switch v.Type() {
+	case fastjson.TypeString:
+		return string(v.GetStringBytes()), nil
+	case fastjson.TypeNumber, fastjson.TypeTrue, fastjson.TypeFalse:
+		return v.String(), nil
+	}
+	return "", fmt.Errorf("invalid exemplar label %q: %s", k, v)
+}
+
+func addExemplarLabel(exemplar map[string]string, k, v string) map[string]string {
+	if exemplar == nil {
+		exemplar = make(map[string]string, 1)
+	}
+	exemplar[k] = v
+	return exemplar
+}
@@ -119,3 +119,82 @@ func BenchmarkJSON(b *testing.B) {
 		}
 	}
 }
+
+func TestParseText_exemplar(t *testing.T) {
+	eventText := []byte(`request_latency_ms|54.7|0|region:us-east-1|trace_id:4bf92f|#span_id:00f067aa`)
+
+	event, err := Parse(eventText)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	assert.Equal(t, event.Labels, map[string]string{"region": "us-east-1"})
+	assert.Equal(t, event.Exemplar, map[string]string{"trace_id": "4bf92f", "span_id": "00f067aa"})
+
+	_, err = Parse([]byte(`request_latency_ms|54.7|0|#:00f067aa`))
+	assert.Error(t, err)
+}
+
+func TestParseJSON_exemplar(t *testing.T) {
+	eventJSON := []byte(`{
+		"event": "request_latency_ms",
+		"value": 54.7,
+		"trace_id": "4bf92f",
+		"exemplar": {"span_id": "00f067aa", "sampled": true, "attempt": 2}
+	}`)
+
+	event, err := ParseJSON(eventJSON)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	assert.Equal(t, event.Name, "request_latency_ms")
+	assert.NotContains(t, event.Labels, "trace_id")
+	assert.NotContains(t, event.Labels, "exemplar")
+	assert.Equal(t, event.Exemplar, map[string]string{
+		"trace_id": "4bf92f",
+		"span_id":  "00f067aa",
+		"sampled":  "true",
+		"attempt":  "2",
+	})
+
+	for _, invalid := range []string{
+		`{"event": "request_latency_ms", "trace_id": null}`,
+		`{"event": "request_latency_ms", "exemplar": {"span_id": ["00f067aa"]}}`,
+		`{"event": "request_latency_ms", "exemplar": "00f067aa"}`,
+	} {
+		_, err := ParseJSON([]byte(invalid))
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestParse_delta(t *testing.T) {
+	for text, want := range map[string]Event{
+		"inflight|5|0":    {Value: 5},
+		"inflight|+5|0":   {Value: 5, Delta: true},
+		"inflight|-3|0":   {Value: -3, Delta: true},
+		"inflight|+0.5|0": {Value: 0.5, Delta: true},
+	} {
+		e, err := Parse([]byte(text))
+		assert.NoError(t, err)
+		assert.Equal(t, e.Value, want.Value, text)
+		assert.Equal(t, e.Delta, want.Delta, text)
+
+		e, err = Parse([]byte(e.Text()))
+		assert.NoError(t, err)
+		assert.Equal(t, e.Delta, want.Delta, "round trip of "+text)
+	}
+
+	for js, want := range map[string]Event{
+		`{"event": "inflight", "value": -3}`:   {Value: -3},
+		`{"event": "inflight", "value": "+5"}`: {Value: 5, Delta: true},
+		`{"event": "inflight", "value": "-3"}`: {Value: -3, Delta: true},
+	} {
+		e, err := ParseJSON([]byte(js))
+		assert.NoError(t, err)
+		assert.Equal(t, e.Value, want.Value, js)
+		assert.Equal(t, e.Delta, want.Delta, js)
+	}
+	_, err := ParseJSON([]byte(`{"event": "inflight", "value": "five"}`))
+	assert.Error(t, err)
+}